@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	batchWorkers int
+	batchRetries int
+)
+
+// jobRetryDelay is the pause before the first retry of a failed batch job;
+// it doubles with every further attempt.
+const jobRetryDelay = 10 * time.Second
+
+func parseBatchFlags(args []string) string {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	fs.IntVar(&batchWorkers, "j", 0, "Jobs run at the same time (default from manifest, else 1)")
+	fs.IntVar(&batchRetries, "job-retries", -1, "Retries of a failed job (default from manifest, else 0)")
+	addTransferFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Println("Error: one manifest file required")
+		os.Exit(1)
+	}
+	return fs.Arg(0)
+}
+
+// batchResult is the outcome of one manifest job.
+type batchResult struct {
+	job      *fwJob
+	err      error
+	attempts int
+	elapsed  time.Duration
+	ran      bool
+}
+
+// runBatch runs the jobs of the manifest at path, writing their messages and
+// a summary to w.
+func runBatch(ctx context.Context, path string, w io.Writer) error {
+	m, err := loadManifest(path)
+	if err != nil {
+		return err
+	}
+	workers, jobRetries := batchWorkers, batchRetries
+	if workers <= 0 {
+		workers = max(m.Concurrency, 1)
+	}
+	workers = min(workers, len(m.Jobs))
+	if jobRetries < 0 {
+		jobRetries = max(m.Retries, 0)
+	}
+	fmt.Fprintf(w, "Running %d jobs, %d at a time.\n", len(m.Jobs), workers)
+
+	var outMu sync.Mutex
+	results := make([]batchResult, len(m.Jobs))
+	for i, j := range m.Jobs {
+		results[i].job = j
+	}
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				j := m.Jobs[i]
+				j.out = &prefixWriter{
+					w:      w,
+					mu:     &outMu,
+					prefix: fmt.Sprintf("[%d/%d %s/%s] ", i+1, len(m.Jobs), j.Model, j.Region),
+				}
+				results[i] = runJob(ctx, j, jobRetries)
+				j.out.(*prefixWriter).Flush()
+			}
+		}()
+	}
+feed:
+	for i := range m.Jobs {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	failed := printSummary(w, results)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d jobs failed", failed, len(results))
+	}
+	return nil
+}
+
+// runJob downloads j, retrying network errors and busy or refused sessions.
+func runJob(ctx context.Context, j *fwJob, retries int) batchResult {
+	start := time.Now()
+	version := j.Version
+	res := batchResult{job: j, ran: true}
+	delay := jobRetryDelay
+	for {
+		res.attempts++
+		j.Version = version
+		if res.err = os.MkdirAll(j.OutDir, 0755); res.err == nil {
+			res.err = j.download(ctx)
+		}
+		if res.err == nil || res.attempts > retries || !retryableJob(res.err) {
+			break
+		}
+		fmt.Fprintf(j.out, "Failed: %v; retrying in %s (attempt %d of %d).\n", res.err, delay, res.attempts+1, retries+1)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			res.err = ctx.Err()
+		case <-t.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		delay *= 2
+	}
+	res.elapsed = time.Since(start)
+	if res.err != nil && ctx.Err() == nil {
+		fmt.Fprintf(j.out, "Failed: %v\n", res.err)
+	}
+	return res
+}
+
+// retryableJob reports whether a failed job may succeed if run again.
+func retryableJob(err error) bool {
+	code, _ := classifyError(err)
+	switch code {
+	case exitNetwork, exitAuth, exitServerBusy:
+		return true
+	}
+	return false
+}
+
+// printSummary writes a table of results to w and returns the number of
+// failed jobs.
+func printSummary(w io.Writer, results []batchResult) int {
+	failed := 0
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w)
+	fmt.Fprintln(tw, "#\tMODEL\tREGION\tVERSION\tSTATUS\tTIME\tDETAIL")
+	for i, r := range results {
+		status, detail := "ok", r.job.result
+		switch {
+		case !r.ran:
+			status, detail = "skipped", "interrupted"
+		case errors.Is(r.err, context.Canceled):
+			status, detail = "interrupted", ""
+		case r.err != nil:
+			failed++
+			status, detail = "failed", r.err.Error()
+		}
+		if r.attempts > 1 {
+			status += fmt.Sprintf(" (%d tries)", r.attempts)
+		}
+		ver := r.job.Version
+		if ver == "" {
+			ver = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", i+1, r.job.Model, r.job.Region, ver, status,
+			r.elapsed.Round(time.Second), detail)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d succeeded, %d failed.\n", countOK(results), failed)
+	return failed
+}
+
+func countOK(results []batchResult) int {
+	n := 0
+	for _, r := range results {
+		if r.ran && r.err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// prefixWriter writes whole lines to w, each starting with prefix, so the
+// messages of concurrent jobs do not interleave within a line.
+type prefixWriter struct {
+	w      io.Writer
+	mu     *sync.Mutex
+	prefix string
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	i := bytes.LastIndexByte(p.buf, '\n')
+	if i < 0 {
+		return len(b), nil
+	}
+	p.write(p.buf[:i+1])
+	p.buf = append(p.buf[:0], p.buf[i+1:]...)
+	return len(b), nil
+}
+
+// Flush writes a trailing incomplete line.
+func (p *prefixWriter) Flush() {
+	if len(p.buf) > 0 {
+		p.write(append(p.buf, '\n'))
+		p.buf = p.buf[:0]
+	}
+}
+
+func (p *prefixWriter) write(lines []byte) {
+	var out bytes.Buffer
+	for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+		if len(line) > 0 {
+			out.WriteString(p.prefix)
+			out.Write(line)
+		}
+	}
+	p.mu.Lock()
+	p.w.Write(out.Bytes())
+	p.mu.Unlock()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mattchengg/susgo/fustest"
+)
+
+func TestRunBatch(t *testing.T) {
+	srv := startServer(t, fustest.Firmware{Model: testModel, Region: testRegion, Version: testVer})
+	defer func(w, r int) { batchWorkers, batchRetries = w, r }(batchWorkers, batchRetries)
+	batchWorkers, batchRetries = 2, -1
+
+	// The second job asks for a model the server does not know.
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "jobs.yaml")
+	yaml := fmt.Sprintf("output: %s\njobs:\n- model: %s\n  region: %s\n  imei: %q\n- model: SM-X000\n  region: %s\n  imei: %q\n",
+		dir, testModel, testRegion, testIMEI, testRegion, testIMEI)
+	if err := os.WriteFile(manifest, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err := runBatch(context.Background(), manifest, &out)
+	if code, _ := classifyError(err); err == nil || code != exitError {
+		t.Errorf("runBatch = %v, exit code %d; want a failure with %d", err, code, exitError)
+	}
+
+	// Every line of a job carries its prefix, up to the summary.
+	log, summary, ok := strings.Cut(out.String(), "\n\n")
+	if !ok {
+		t.Fatalf("no summary:\n%s", out.String())
+	}
+	prefixes := []string{"[1/2 SM-S928B/EUX] ", "[2/2 SM-X000/EUX] "}
+	lines := map[string][]string{}
+	for i, line := range strings.Split(log, "\n") {
+		if i == 0 {
+			continue // Running 2 jobs
+		}
+		found := false
+		for _, p := range prefixes {
+			if rest, ok := strings.CutPrefix(line, p); ok {
+				lines[p] = append(lines[p], rest)
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("line without a job prefix: %q", line)
+		}
+	}
+	if got := strings.Join(lines[prefixes[0]], "\n"); !strings.Contains(got, "Done, checksums verified.") {
+		t.Errorf("job 1 did not report its download:\n%s", got)
+	}
+	if got := strings.Join(lines[prefixes[1]], "\n"); !strings.Contains(got, "Failed: ") {
+		t.Errorf("job 2 did not report its failure:\n%s", got)
+	}
+
+	for _, want := range []string{"1  SM-S928B  EUX", "ok", "2  SM-X000   EUX", "failed", "1 succeeded, 1 failed."} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("summary lacks %q:\n%s", want, summary)
+		}
+	}
+	zips, _ := filepath.Glob(filepath.Join(dir, "*.zip"))
+	if len(zips) != 1 {
+		t.Fatalf("%d zips in the output directory, want 1", len(zips))
+	}
+	if got, err := os.ReadFile(zips[0]); err != nil || !bytes.Equal(got, srv.Plaintext(testModel, testRegion, testVer)) {
+		t.Errorf("job 1 firmware differs from the served zip: %v", err)
+	}
+}
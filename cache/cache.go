@@ -0,0 +1,269 @@
+// Package cache keeps verified encrypted firmware files in a directory that
+// several susgo processes, also on different machines sharing it over NFS,
+// use together. Files are stored once under their MD5 and indexed by model,
+// region and version; a lock per firmware makes concurrent processes wait
+// for the one already downloading it instead of fetching it again.
+package cache
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lockPoll is how often a waiting Lock retries.
+const lockPoll = 500 * time.Millisecond
+
+// Cache is a cache directory:
+//
+//	objects/<md5>                          the encrypted firmware files
+//	index/<model>/<region>/<version>.json  the Entry of each firmware
+//	locks/<model>_<region>_<version>.lock  held while one is downloaded
+type Cache struct {
+	Dir string
+}
+
+// Open returns the cache in dir, creating the directory if needed.
+func Open(dir string) (*Cache, error) {
+	for _, sub := range []string{"objects", "index", "locks"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+// Key identifies a firmware file.
+type Key struct {
+	Model   string
+	Region  string
+	Version string // normalized four-part version
+}
+
+func (k Key) String() string {
+	return k.Model + "/" + k.Region + "/" + k.Version
+}
+
+// clean makes a string usable as a single path element.
+var clean = strings.NewReplacer("/", "_", "\\", "_", "..", "_")
+
+// name returns k as a single path element.
+func (k Key) name() string {
+	return clean.Replace(k.Model + "_" + k.Region + "_" + k.Version)
+}
+
+func (k Key) indexPath(dir string) string {
+	return filepath.Join(dir, "index", clean.Replace(k.Model), clean.Replace(k.Region), clean.Replace(k.Version)+".json")
+}
+
+// Entry describes a cached firmware file.
+type Entry struct {
+	Model      string    `json:"model"`
+	Region     string    `json:"region"`
+	Version    string    `json:"version"`
+	BinaryName string    `json:"binary_name"`
+	Size       int64     `json:"size"`
+	MD5        string    `json:"md5"`
+	CRC32      uint32    `json:"crc32,omitempty"`
+	Added      time.Time `json:"added"`
+
+	// Stamp identifies the object file as it was when its MD5 was last
+	// verified; see Lookup.
+	Stamp string `json:"stamp,omitempty"`
+
+	// Path is the location of the file in the cache.
+	Path string `json:"-"`
+}
+
+func (c *Cache) objectPath(md5 string) string {
+	return filepath.Join(c.Dir, "objects", md5)
+}
+
+// Lookup returns the entry of k, or nil if the cache has no complete file
+// for it. When the object file has changed since its MD5 was last verified,
+// which a partial copy or a write through a link does, it is hashed again
+// and removed if it no longer matches.
+func (c *Cache) Lookup(k Key) (*Entry, error) {
+	data, err := os.ReadFile(k.indexPath(c.Dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, fmt.Errorf("cache index of %s: %w", k, err)
+	}
+	if _, err := hex.DecodeString(e.MD5); err != nil || len(e.MD5) != 32 {
+		return nil, fmt.Errorf("cache index of %s: invalid MD5 %q", k, e.MD5)
+	}
+	e.Path = c.objectPath(e.MD5)
+	info, err := os.Stat(e.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != e.Size {
+		return nil, nil
+	}
+	if st := stamp(info); st != e.Stamp {
+		sum, err := fileMD5(e.Path)
+		if err != nil {
+			return nil, err
+		}
+		if sum != e.MD5 {
+			os.Chmod(e.Path, 0644)
+			if err := os.Remove(e.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+			return nil, nil
+		}
+		e.Stamp = st
+		if err := c.writeIndex(e); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// stamp identifies the content of the file described by info as far as its
+// metadata tells.
+func stamp(info fs.FileInfo) string {
+	return fmt.Sprintf("%d-%d-%d", info.Size(), info.ModTime().UnixNano(), inode(info))
+}
+
+// fileMD5 returns the hex MD5 of the file at path.
+func fileMD5(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Put adds a copy of the verified file at path as e. e.MD5 must be the hex
+// MD5 of the file. Objects are read-only, so the file is copied rather than
+// linked, leaving the caller's file as it was.
+func (c *Cache) Put(path string, e *Entry) error {
+	if _, err := hex.DecodeString(e.MD5); err != nil || len(e.MD5) != 32 {
+		return fmt.Errorf("invalid MD5 %q", e.MD5)
+	}
+	e.Path = c.objectPath(e.MD5)
+	if info, err := os.Stat(e.Path); err != nil || info.Size() != e.Size {
+		tmp := fmt.Sprintf("%s.%d.tmp", e.Path, os.Getpid())
+		os.Remove(tmp)
+		if err := CopyFile(path, tmp); err != nil {
+			return err
+		}
+		if err := os.Chmod(tmp, 0444); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, e.Path); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if info, err := os.Stat(e.Path); err == nil {
+			e.Stamp = stamp(info)
+		}
+	}
+	// An object that was there already is verified by the next Lookup.
+	if e.Added.IsZero() {
+		e.Added = time.Now().UTC()
+	}
+	return c.writeIndex(e)
+}
+
+// writeIndex records e in the index.
+func (c *Cache) writeIndex(e *Entry) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	k := Key{Model: e.Model, Region: e.Region, Version: e.Version}
+	index := k.indexPath(c.Dir)
+	if err := os.MkdirAll(filepath.Dir(index), 0755); err != nil {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", index, os.Getpid())
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, index)
+}
+
+// Lock takes the lock of k, waiting while another process holds it. If it
+// has to wait, waiting is called once. The returned function releases the
+// lock. Where file locking is unsupported, Lock does not lock.
+func (c *Cache) Lock(ctx context.Context, k Key, waiting func()) (unlock func(), err error) {
+	fd, err := os.OpenFile(filepath.Join(c.Dir, "locks", k.name()+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	t := time.NewTicker(lockPoll)
+	defer t.Stop()
+	for {
+		ok, err := tryLock(fd)
+		if errors.Is(err, errors.ErrUnsupported) {
+			ok, err = true, nil
+		}
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		if ok {
+			return func() { fd.Close() }, nil
+		}
+		if waiting != nil {
+			waiting()
+			waiting = nil
+		}
+		select {
+		case <-ctx.Done():
+			fd.Close()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// CopyFile creates dst as a writable copy of src; on Linux, filesystems that
+// support it share the data until it is written. dst must not exist.
+func CopyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
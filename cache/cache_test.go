@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// putFile writes data to a file in a temporary directory and adds it to c.
+func putFile(t *testing.T, c *Cache, data []byte) (string, *Entry) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "fw.zip.enc4")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(data)
+	e := &Entry{
+		Model:      "SM-S928B",
+		Region:     "EUX",
+		Version:    "A/B/C/D",
+		BinaryName: "fw.zip.enc4",
+		Size:       int64(len(data)),
+		MD5:        hex.EncodeToString(sum[:]),
+	}
+	if err := c.Put(path, e); err != nil {
+		t.Fatal(err)
+	}
+	return path, e
+}
+
+var testKey = Key{Model: "SM-S928B", Region: "EUX", Version: "A/B/C/D"}
+
+func TestPutLookup(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := c.Lookup(testKey); err != nil || e != nil {
+		t.Fatalf("Lookup of empty cache = %v, %v", e, err)
+	}
+	_, put := putFile(t, c, []byte("firmware"))
+	e, err := c.Lookup(testKey)
+	if err != nil || e == nil {
+		t.Fatalf("Lookup = %v, %v", e, err)
+	}
+	if e.Path != put.Path || e.MD5 != put.MD5 || e.Stamp == "" {
+		t.Errorf("Lookup = %+v, want %+v", e, put)
+	}
+	info, err := os.Stat(e.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0222 != 0 {
+		t.Errorf("object mode = %v, want read-only", info.Mode())
+	}
+}
+
+func TestLookupEvictsCorruptObject(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, e := putFile(t, c, []byte("firmware"))
+
+	// Same size, different content and modification time.
+	os.Chmod(e.Path, 0644)
+	if err := os.WriteFile(e.Path, []byte("fiRmware"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(e.Path, time.Time{}, time.Now().Add(time.Hour))
+
+	if got, err := c.Lookup(testKey); err != nil || got != nil {
+		t.Fatalf("Lookup of corrupt object = %v, %v, want nil", got, err)
+	}
+	if _, err := os.Stat(e.Path); !os.IsNotExist(err) {
+		t.Errorf("corrupt object not removed: %v", err)
+	}
+}
+
+func TestLookupReverifiesChangedStamp(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, e := putFile(t, c, []byte("firmware"))
+
+	// Touched but intact: verified again and kept, with a new stamp.
+	os.Chtimes(e.Path, time.Time{}, time.Now().Add(time.Hour))
+	got, err := c.Lookup(testKey)
+	if err != nil || got == nil {
+		t.Fatalf("Lookup = %v, %v", got, err)
+	}
+	if got.Stamp == e.Stamp {
+		t.Errorf("stamp not updated after verification")
+	}
+}
+
+func TestPutCopies(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, e := putFile(t, c, []byte("firmware"))
+
+	// The file stays writable and independent of the cache.
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm()&0200 == 0 {
+		t.Fatalf("file made read-only by Put: %v, %v", info.Mode(), err)
+	}
+	if err := os.WriteFile(path, []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(e.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "firmware" {
+		t.Errorf("object = %q after writing the copied file", data)
+	}
+}
+
+func TestLock(t *testing.T) {
+	c, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock, err := c.Lock(context.Background(), testKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*lockPoll)
+	defer cancel()
+	waited := false
+	if _, err := c.Lock(ctx, testKey, func() { waited = true }); err != context.DeadlineExceeded {
+		t.Errorf("second Lock = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if !waited {
+		t.Error("waiting was not called")
+	}
+	unlock()
+	unlock, err = c.Lock(context.Background(), testKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package cache
+
+import (
+	"errors"
+	"os"
+)
+
+func tryLock(fd *os.File) (bool, error) {
+	return false, errors.ErrUnsupported
+}
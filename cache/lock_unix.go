@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+package cache
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive lock on fd without waiting and reports whether
+// it got it. On Linux, flock locks on NFS are forwarded to the server.
+func tryLock(fd *os.File) (bool, error) {
+	err := syscall.Flock(int(fd.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package cache
+
+import "io/fs"
+
+func inode(info fs.FileInfo) uint64 {
+	return 0
+}
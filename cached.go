@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattchengg/susgo/cache"
+	"github.com/mattchengg/susgo/download"
+	"github.com/mattchengg/susgo/firmware"
+)
+
+func cacheKey(dl *download.Downloader) cache.Key {
+	return cache.Key{Model: dl.Model, Region: dl.Region, Version: dl.Version}
+}
+
+// lookupCache returns the cache entry of the firmware of dl, ignoring one
+// recorded for another file.
+func lookupCache(dl *download.Downloader) (*cache.Entry, error) {
+	e, err := fwCache.Lookup(cacheKey(dl))
+	if err != nil || e == nil {
+		return nil, err
+	}
+	if e.BinaryName != dl.BinaryName || e.Size != dl.Size {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// fromCache produces the output of the download from the cache if the
+// firmware is there: the encrypted file is copied to out, as if downloaded,
+// and decrypted with key, then removed unless kept with -k. Otherwise it takes the lock of
+// the firmware, waiting while another process downloads it, and returns the
+// function releasing it once the caller has downloaded and cached the
+// firmware.
+func (j *fwJob) fromCache(ctx context.Context, dl *download.Downloader, key []byte, out, decFile string) (hit bool, unlock func(), err error) {
+	e, err := lookupCache(dl)
+	if err == nil && e == nil {
+		unlock, err = fwCache.Lock(ctx, cacheKey(dl), func() {
+			fmt.Fprintln(j.out, "Waiting for another download of this firmware to the cache...")
+		})
+		if err != nil {
+			return false, nil, err
+		}
+		if e, err = lookupCache(dl); err == nil && e == nil {
+			return false, unlock, nil
+		}
+		unlock()
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	fmt.Fprintf(j.out, "Found in cache: %s\n", e.Path)
+	if err := checkFileKey(e.Path, key); err != nil {
+		return false, nil, err
+	}
+	for _, p := range []string{dl.EncryptedPath, out, decFile} {
+		if p != "" {
+			os.Remove(download.TempPath(p))
+			os.Remove(download.StatePath(p))
+		}
+	}
+	if !noSpace {
+		if err := download.CheckSpace(decFile, 2*e.Size); err != nil {
+			return false, nil, err
+		}
+	}
+	os.Remove(out)
+	if err := cache.CopyFile(e.Path, download.TempPath(out)); err != nil {
+		return false, nil, err
+	}
+	if err := os.Rename(download.TempPath(out), out); err != nil {
+		return false, nil, err
+	}
+	fmt.Fprint(j.out, "Decrypting...")
+	start := time.Now()
+	if err := firmware.DecryptFile(ctx, out, decFile, key, workers, nil); err != nil {
+		fmt.Fprintln(j.out)
+		return false, nil, fmt.Errorf("decrypt: %w", err)
+	}
+	fmt.Fprintf(j.out, " Done, %s.\n", decryptStats(e.Size, time.Since(start), workerCount()))
+	if !keepEnc {
+		os.Remove(out)
+	}
+	return true, nil, nil
+}
+
+// toCache adds the verified encrypted file at out to the cache. Failing to
+// cache it does not fail the download.
+func (j *fwJob) toCache(dl *download.Downloader, out string) {
+	sum := dl.Sum()
+	if fwCache == nil || sum.Size != dl.Size || sum.MD5 == nil {
+		return
+	}
+	e := &cache.Entry{
+		Model:      dl.Model,
+		Region:     dl.Region,
+		Version:    dl.Version,
+		BinaryName: dl.BinaryName,
+		Size:       dl.Size,
+		MD5:        hex.EncodeToString(sum.MD5),
+		CRC32:      sum.CRC32,
+	}
+	if err := fwCache.Put(out, e); err != nil {
+		fmt.Fprintf(j.out, "Not cached: %v\n", err)
+		return
+	}
+	fmt.Fprintf(j.out, "Cached as %s\n", e.Path)
+}
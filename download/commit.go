@@ -0,0 +1,85 @@
+package download
+
+import (
+	"context"
+	"crypto/aes"
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// TempPath returns the temporary name a download of path is written to
+// until it is complete and verified.
+func TempPath(path string) string {
+	return path + ".part"
+}
+
+// inspect reports whether path holds a file the size of the completed
+// download, which is only trusted once verified, and otherwise
+// which file holds the partial download: TempPath(path), or path itself if
+// it is an unverified partial download left by an older susgo with no
+// temporary file next to it. It changes nothing on disk.
+func (d *Downloader) inspect(path string) (done bool, partial string, err error) {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, TempPath(path), nil
+	}
+	if err != nil {
+		return false, "", err
+	}
+	size := info.Size()
+	if d.Key == nil && size == d.Size || d.Key != nil && size >= d.Size-aes.BlockSize && size < d.Size {
+		return true, "", nil
+	}
+	if _, err := os.Stat(TempPath(path)); err == nil {
+		return false, TempPath(path), nil
+	}
+	return false, path, nil
+}
+
+// finished is inspect for a download about to start: a complete file at
+// path is verified, and removed to be downloaded again if it fails; a
+// partial download left at path by an older susgo is moved to the
+// temporary name to be validated like any other partial file, or removed
+// if there is one already.
+func (d *Downloader) finished(ctx context.Context, path string) (bool, error) {
+	done, partial, err := d.inspect(path)
+	if err != nil {
+		return false, err
+	}
+	if done {
+		err := d.Verify(ctx, path)
+		var ie *IntegrityError
+		if !errors.As(err, &ie) {
+			return err == nil, err
+		}
+		if d.OnRestart != nil {
+			d.OnRestart("it failed verification: " + err.Error())
+		}
+		return false, os.Remove(path)
+	}
+	if partial == path {
+		return false, os.Rename(path, TempPath(path))
+	}
+	if _, err := os.Stat(path); err == nil {
+		return false, os.Remove(path)
+	}
+	return false, nil
+}
+
+// commit moves a verified download into place, stripping the padding of a
+// file decrypted on the fly. The encrypted copy goes first, so that path
+// existing always means the whole download is done.
+func (d *Downloader) commit(path string) error {
+	if d.Key != nil {
+		if err := d.finish(TempPath(path)); err != nil {
+			return err
+		}
+		if d.EncryptedPath != "" {
+			if err := os.Rename(TempPath(d.EncryptedPath), d.EncryptedPath); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(TempPath(path), path)
+}
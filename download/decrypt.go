@@ -0,0 +1,233 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"io"
+	"os"
+
+	"github.com/mattchengg/susgo/firmware"
+)
+
+// ErrBadPadding is returned when the last block of a file decrypted on the
+// fly does not end in valid PKCS#7 padding, which means the key is wrong. It
+// is the error firmware decryption reports for the same.
+var ErrBadPadding = firmware.ErrBadPadding
+
+// output is the file a download writes to. Data written to it is
+// ciphertext; with a key it is stored decrypted, at the same offsets and
+// with the padding kept until the download is finished, and reading it back
+// re-encrypts it, block by block; see firmware.Cipher.
+type output struct {
+	*os.File
+	c   *firmware.Cipher // nil stores data as is
+	enc *os.File         // optional copy of the ciphertext
+}
+
+// openOutput opens the temporary file of path, and that of the encrypted
+// copy if one is kept, for reading and writing.
+func (d *Downloader) openOutput(path string) (*output, error) {
+	c, err := d.cipher()
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(TempPath(path), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	o := &output{File: fd, c: c}
+	if c != nil && d.EncryptedPath != "" {
+		if o.enc, err = os.OpenFile(TempPath(d.EncryptedPath), os.O_CREATE|os.O_RDWR, 0644); err != nil {
+			fd.Close()
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+func (d *Downloader) cipher() (*firmware.Cipher, error) {
+	if d.Key == nil {
+		return nil, nil
+	}
+	return firmware.NewCipher(d.Key)
+}
+
+// CheckKey fetches the first block of the file and returns
+// firmware.ErrWrongKey unless d.Key decrypts it to the start of a zip, so
+// that a wrong key is found before any output is written. Without a Key
+// there is nothing to check. The session must already be initialized.
+func (d *Downloader) CheckKey(ctx context.Context) error {
+	if d.Key == nil {
+		return nil
+	}
+	resp, err := d.Client.DownloadRange(ctx, d.file(), 0, aes.BlockSize-1)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	d.noteResponse(resp)
+	first := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		return err
+	}
+	if !firmware.CheckKey(first, d.Key) {
+		return firmware.ErrWrongKey
+	}
+	return nil
+}
+
+// blockAlign rounds n down to a cipher block boundary when decrypting.
+func (d *Downloader) blockAlign(n int64) int64 {
+	if d.Key == nil {
+		return n
+	}
+	return n &^ (aes.BlockSize - 1)
+}
+
+func (o *output) plain(p []byte) []byte {
+	if o.c == nil {
+		return p
+	}
+	buf := bytes.Clone(p)
+	o.c.Decrypt(buf)
+	return buf
+}
+
+func (o *output) Write(p []byte) (int, error) {
+	if o.enc != nil {
+		off, err := o.File.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := o.enc.WriteAt(p, off); err != nil {
+			return 0, err
+		}
+	}
+	return o.File.Write(o.plain(p))
+}
+
+func (o *output) WriteAt(p []byte, off int64) (int, error) {
+	if o.enc != nil {
+		if _, err := o.enc.WriteAt(p, off); err != nil {
+			return 0, err
+		}
+	}
+	return o.File.WriteAt(o.plain(p), off)
+}
+
+// Read returns the ciphertext of the file from the current offset.
+func (o *output) Read(p []byte) (int, error) {
+	if o.c == nil || len(p) < aes.BlockSize {
+		return o.File.Read(p)
+	}
+	n, err := io.ReadFull(o.File, p[:len(p)&^(aes.BlockSize-1)])
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	o.c.Encrypt(p[:n])
+	return n, err
+}
+
+// ReadAt returns the ciphertext of the file at off.
+func (o *output) ReadAt(p []byte, off int64) (int, error) {
+	n, err := o.File.ReadAt(p, off)
+	if o.c != nil {
+		o.c.Encrypt(p[:n])
+	}
+	return n, err
+}
+
+func (o *output) Truncate(size int64) error {
+	if o.enc != nil {
+		if err := o.enc.Truncate(size); err != nil {
+			return err
+		}
+	}
+	return o.File.Truncate(size)
+}
+
+func (o *output) Sync() error {
+	if o.enc != nil {
+		if err := o.enc.Sync(); err != nil {
+			return err
+		}
+	}
+	return o.File.Sync()
+}
+
+func (o *output) Close() error {
+	if o.enc != nil {
+		o.enc.Close()
+	}
+	return o.File.Close()
+}
+
+// syncCopy brings the encrypted copy to the size of the file, re-encrypting
+// the file if the copy was not kept so far.
+func (o *output) syncCopy(ctx context.Context) error {
+	if o.enc == nil {
+		return nil
+	}
+	info, err := o.File.Stat()
+	if err != nil {
+		return err
+	}
+	encInfo, err := o.enc.Stat()
+	if err != nil {
+		return err
+	}
+	if encInfo.Size() == info.Size() {
+		return nil
+	}
+	r := io.NewSectionReader(&output{File: o.File, c: o.c}, 0, info.Size())
+	if err := o.enc.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := io.Copy(o.enc, ctxReader{ctx, r}); err != nil {
+		return err
+	}
+	_, err = o.enc.Seek(0, io.SeekStart)
+	return err
+}
+
+// ctxReader stops reading once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// finish strips the padding from a file decrypted on the fly.
+func (d *Downloader) finish(path string) error {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	last := make([]byte, aes.BlockSize)
+	if info.Size() < aes.BlockSize {
+		return ErrBadPadding
+	}
+	if _, err := fd.ReadAt(last, info.Size()-aes.BlockSize); err != nil {
+		return err
+	}
+	pad, err := firmware.PaddingLen(last)
+	if err != nil {
+		return err
+	}
+	if err := fd.Truncate(info.Size() - int64(pad)); err != nil {
+		return err
+	}
+	return fd.Close()
+}
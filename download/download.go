@@ -0,0 +1,316 @@
+// Package download fetches firmware files from FUS into local files, over a
+// single connection or several concurrent ranged connections, and resumes
+// interrupted downloads.
+package download
+
+import (
+	"context"
+	"crypto/aes"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattchengg/susgo/fus"
+)
+
+// Downloader fetches one firmware file.
+type Downloader struct {
+	Client     *fus.Client
+	ModelPath  string // MODEL_PATH
+	BinaryName string // BINARY_NAME
+	Size       int64  // BINARY_BYTE_SIZE
+
+	// Model, Region and Version are recorded with a partial download, so
+	// that it is never resumed as part of another firmware.
+	Model   string
+	Region  string
+	Version string
+
+	// CRC32, if non-zero, is the expected IEEE CRC-32 of the whole file as
+	// sent in BINARY_CRC. The file is also checked against its size and
+	// the Content-MD5 of the download responses.
+	CRC32 uint32
+
+	// Key, if set, decrypts the firmware while it downloads, so that the
+	// output receives the plaintext zip instead of the encrypted file. If
+	// EncryptedPath is also set, the encrypted file is written there too.
+	Key           []byte
+	EncryptedPath string
+
+	// Connections is the number of concurrent ranged requests. Values
+	// above one split the file into segments, so that each segment
+	// resumes independently.
+	Connections int
+	// SegmentSize overrides the automatically chosen segment size.
+	SegmentSize int64
+
+	// Limiter, if set, caps the throughput of all connections together.
+	// It may be shared with other Downloaders.
+	Limiter *Limiter
+
+	// Progress, if set, is called with the number of bytes written after
+	// every write. It may be called from several goroutines at once.
+	Progress func(n int64)
+
+	// OnResponse, if set, is called with every download response before
+	// its body is read.
+	OnResponse func(resp *http.Response)
+
+	// OnRestart, if set, is called with the reason when an existing
+	// partial file does not match its state, or a complete one fails
+	// verification, and is downloaded again.
+	OnRestart func(reason string)
+
+	// OnReconnect, if set, is called with the offset reached and the error
+	// when a connection failed mid-transfer and is resumed. It may be
+	// called from several goroutines at once.
+	OnReconnect func(offset int64, err error)
+
+	// StallTimeout, if positive, counts a connection that receives no data
+	// for that long as stalled. MinSpeed, if positive, does so for one that
+	// receives less than MinSpeed bytes per second over StallTimeout, or
+	// DefaultStallWindow, of waiting for data; time spent in the Limiter
+	// does not count. A stalled connection is closed and reopened at the
+	// offset reached, like a dropped one, with an error wrapping
+	// ErrStalled passed to OnReconnect.
+	StallTimeout time.Duration
+	MinSpeed     int64
+
+	stalls     atomic.Int64
+	mu         sync.Mutex
+	contentMD5 []byte
+	sum        Digest
+}
+
+// Stalls returns how many stalled connections have been reopened.
+func (d *Downloader) Stalls() int {
+	return int(d.stalls.Load())
+}
+
+func (d *Downloader) file() string {
+	return d.ModelPath + d.BinaryName
+}
+
+// Status reports how many bytes of path are already downloaded and can be
+// resumed. A file of the complete size reports d.Size, left for ToFile to
+// verify; a partial file of another firmware, or one that does not match
+// its state file, reports zero. It only inspects the files, leaving them
+// for ToFile to clean up.
+func (d *Downloader) Status(path string) (int64, error) {
+	done, partial, err := d.inspect(path)
+	if err != nil || done {
+		return d.Size, err
+	}
+	st, size, reason, err := d.resumeState(path, partial)
+	if err != nil || reason != "" {
+		return 0, err
+	}
+	if st != nil && st.Segments != nil {
+		return st.done(), nil
+	}
+	return size, nil
+}
+
+// ToFile downloads into path, resuming whatever part of it is already
+// present, and verifies the result. The data is written to TempPath(path)
+// and renamed to path only once verified; a complete file already at path
+// is verified again, and downloaded anew if it fails. Progress is tracked in a state file next to path, and flushed on
+// cancellation so a later call resumes where this one stopped. A partial
+// file that does not match its state is discarded. A file that fails
+// verification is left at its temporary name and an *IntegrityError
+// returned.
+func (d *Downloader) ToFile(ctx context.Context, path string) error {
+	if done, err := d.finished(ctx, path); err != nil || done {
+		return err
+	}
+	st, size, reason, err := d.resumeState(path, TempPath(path))
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		if d.OnRestart != nil {
+			d.OnRestart(reason)
+		}
+		if err := os.Remove(TempPath(path)); err != nil {
+			return err
+		}
+		size = 0
+	}
+	if st == nil {
+		if err := os.Remove(StatePath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if d.Connections > 1 || st != nil && st.Segments != nil {
+		return d.segmented(ctx, path, st)
+	}
+	return d.sequential(ctx, path, st, size)
+}
+
+func (d *Downloader) sequential(ctx context.Context, path string, st *state, offset int64) error {
+	if offset >= d.Size {
+		return d.complete(ctx, path)
+	}
+
+	o, err := d.openOutput(path)
+	if err != nil {
+		return err
+	}
+	defer o.Close()
+
+	// A decrypted file can only be resumed from a whole block.
+	if aligned := d.blockAlign(offset); aligned != offset {
+		offset = aligned
+		if err := o.File.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	if err := o.syncCopy(ctx); err != nil {
+		return err
+	}
+
+	// Continue from the recorded hash state and hash whatever was written
+	// after it was saved, leaving o at the end of the file.
+	h := newHasher()
+	if st != nil && st.Hash != nil {
+		if h, err = restoreHasher(st.Hash); err != nil {
+			return err
+		}
+		if _, err := o.Seek(h.n, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	if err := hashPrefix(ctx, h, o, offset-h.n); err != nil {
+		return err
+	}
+
+	if st == nil {
+		st = d.newState()
+	}
+	w := &hashWriter{w: o, h: h, st: st, path: path}
+	if err := w.save(); err != nil {
+		return err
+	}
+
+	err = d.transfer(ctx, w, offset, d.Size)
+	if serr := w.save(); err == nil {
+		err = serr
+	}
+	if cerr := o.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(StatePath(path)); err != nil {
+		return err
+	}
+	if err := d.fetchMD5(ctx); err != nil {
+		return err
+	}
+	if err := d.check(h.digest()); err != nil {
+		return err
+	}
+	return d.commit(path)
+}
+
+// complete verifies a file that needs no more data, drops its state and
+// commits it.
+func (d *Downloader) complete(ctx context.Context, path string) error {
+	if err := os.Remove(StatePath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if d.Key != nil && d.EncryptedPath != "" {
+		o, err := d.openOutput(path)
+		if err != nil {
+			return err
+		}
+		err = o.syncCopy(ctx)
+		o.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := d.Verify(ctx, TempPath(path)); err != nil {
+		return err
+	}
+	return d.commit(path)
+}
+
+// hashWriter appends to the file and the hasher, and periodically records
+// the hash state so a resumed download need not rehash the whole prefix.
+type hashWriter struct {
+	w     io.Writer
+	h     *hasher
+	st    *state
+	path  string
+	saved time.Time
+}
+
+func (w *hashWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.h.Write(p[:n])
+	if err == nil && time.Since(w.saved) >= stateSaveInterval {
+		err = w.save()
+	}
+	return n, err
+}
+
+func (w *hashWriter) save() error {
+	hs, err := w.h.snapshot()
+	if err != nil {
+		return err
+	}
+	w.st.mu.Lock()
+	w.st.Hash = hs
+	w.st.mu.Unlock()
+	w.saved = time.Now()
+	return w.st.save(w.path)
+}
+
+// copy streams body into w until EOF or until ctx is cancelled. Only whole
+// cipher blocks are written before EOF, so a partial download always ends on
+// a block boundary and can be decrypted and resumed from there.
+func (d *Downloader) copy(ctx context.Context, w io.Writer, body io.Reader) error {
+	buf := make([]byte, 32768)
+	n := 0
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m, err := body.Read(buf[n:])
+		n += m
+		flush := n &^ (aes.BlockSize - 1)
+		if err == io.EOF {
+			flush = n
+		}
+		if flush > 0 {
+			if _, werr := w.Write(buf[:flush]); werr != nil {
+				return werr
+			}
+			d.progress(int64(flush))
+			n = copy(buf, buf[flush:n])
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := d.Limiter.wait(ctx, m); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Downloader) progress(n int64) {
+	if d.Progress != nil {
+		d.Progress(n)
+	}
+}
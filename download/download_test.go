@@ -0,0 +1,149 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattchengg/susgo/firmware"
+	"github.com/mattchengg/susgo/fus"
+	"github.com/mattchengg/susgo/fustest"
+)
+
+const (
+	testModel   = "SM-S928B"
+	testRegion  = "EUX"
+	testVersion = "S928BXXS4CYK8/S928BOXM4CYK8/S928BXXS4CYK8/S928BXXS4CYK8"
+	testIMEI    = "351234567871819"
+)
+
+// testRetry keeps the backoff between reconnects short.
+var testRetry = fus.RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+// newTestDownloader starts a fustest.Server with a small firmware and
+// returns a Downloader of it, with the session initialized, and the server.
+func newTestDownloader(t *testing.T, opts ...fus.Option) (*Downloader, *fustest.Server) {
+	t.Helper()
+	srv, err := fustest.NewServer(fustest.Firmware{Model: testModel, Region: testRegion, Version: testVersion, MemberSize: 16 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	opts = append(append(srv.FUSOptions(), fus.WithRetry(testRetry)), opts...)
+	c, err := fus.NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.BinaryInform(ctx, testVersion, testModel, testRegion, testIMEI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BinaryInit(ctx, info.BinaryName); err != nil {
+		t.Fatal(err)
+	}
+	return &Downloader{
+		Client:     c,
+		ModelPath:  info.ModelPath,
+		BinaryName: info.BinaryName,
+		Size:       info.BinaryByteSize,
+		Model:      testModel,
+		Region:     testRegion,
+		Version:    testVersion,
+		CRC32:      info.BinaryCRC,
+	}, srv
+}
+
+// testKey returns the .enc4 key of the firmware d downloads.
+func testKey(t *testing.T, d *Downloader) []byte {
+	t.Helper()
+	info, err := d.Client.BinaryInform(context.Background(), testVersion, testModel, testRegion, testIMEI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := firmware.V4Key(info.LatestFWVersion, info.LogicValueFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// checkOutput checks that path holds want and that no temporary or state
+// file is left next to it.
+func checkOutput(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s: got %d bytes differing from the %d expected", filepath.Base(path), len(got), len(want))
+	}
+	for _, p := range []string{TempPath(path), StatePath(path)} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", filepath.Base(p), err)
+		}
+	}
+}
+
+func TestToFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		connections int
+		decrypt     bool
+	}{
+		{"single", 1, false},
+		{"segmented", 4, false},
+		{"single decrypting", 1, true},
+		{"segmented decrypting", 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, srv := newTestDownloader(t)
+			d.Connections = tt.connections
+			d.SegmentSize = 16 << 10
+			want := srv.Ciphertext(testModel, testRegion, testVersion)
+			if tt.decrypt {
+				d.Key = testKey(t, d)
+				want = srv.Plaintext(testModel, testRegion, testVersion)
+			}
+			var progress atomic.Int64
+			d.Progress = func(n int64) { progress.Add(n) }
+
+			path := filepath.Join(t.TempDir(), "fw.zip")
+			if err := d.ToFile(context.Background(), path); err != nil {
+				t.Fatal(err)
+			}
+			checkOutput(t, path, want)
+			if sum := d.Sum(); sum.Size != d.Size || sum.CRC32 != d.CRC32 {
+				t.Errorf("Sum() = %+v, want size %d and CRC-32 %08x", sum, d.Size, d.CRC32)
+			}
+			if n := progress.Load(); n != d.Size {
+				t.Errorf("progress reported %d bytes, want %d", n, d.Size)
+			}
+		})
+	}
+}
+
+func TestToWriter(t *testing.T) {
+	for _, decrypt := range []bool{false, true} {
+		d, srv := newTestDownloader(t)
+		want := srv.Ciphertext(testModel, testRegion, testVersion)
+		if decrypt {
+			d.Key = testKey(t, d)
+			want = srv.Plaintext(testModel, testRegion, testVersion)
+		}
+		var buf bytes.Buffer
+		if err := d.ToWriter(context.Background(), &buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("decrypt %v: streamed %d bytes differing from the %d expected", decrypt, buf.Len(), len(want))
+		}
+	}
+}
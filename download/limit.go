@@ -0,0 +1,112 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter caps the combined throughput of every download and segment that
+// shares it. The zero value does not limit.
+type Limiter struct {
+	Rate int64 // bytes per second; zero or negative means unlimited
+
+	// FullSpeed lists daily periods in which Rate does not apply, e.g. a
+	// night window for long pulls over a shared link.
+	FullSpeed []Window
+
+	mu   sync.Mutex
+	next time.Time // when the bytes reserved so far have been paid for
+}
+
+// wait accounts for n bytes just read and sleeps for as long as the rate
+// requires before the caller reads more.
+func (l *Limiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.Rate <= 0 || l.fullSpeed(now) {
+		l.next = now
+		l.mu.Unlock()
+		return nil
+	}
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.Rate) * float64(time.Second)))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (l *Limiter) fullSpeed(t time.Time) bool {
+	for _, w := range l.FullSpeed {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Window is a daily period from Start to End, both offsets from local
+// midnight. A window whose End is before its Start wraps past midnight.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// Contains reports whether the time of day of t falls in w.
+func (w Window) Contains(t time.Time) bool {
+	h, m, s := t.Clock()
+	tod := time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(s)*time.Second
+	if w.Start <= w.End {
+		return tod >= w.Start && tod < w.End
+	}
+	return tod >= w.Start || tod < w.End
+}
+
+// ParseWindows parses a comma-separated list of HH:MM-HH:MM periods, such
+// as "20:00-07:00,12:00-13:30".
+func ParseWindows(s string) ([]Window, error) {
+	var windows []Window
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window %q, want HH:MM-HH:MM", part)
+		}
+		var w Window
+		var err error
+		if w.Start, err = parseClock(start); err != nil {
+			return nil, err
+		}
+		if w.End, err = parseClock(end); err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
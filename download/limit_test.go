@@ -0,0 +1,100 @@
+package download
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLimiterWait(t *testing.T) {
+	ctx := context.Background()
+	day := []Window{{Start: 0, End: 24 * time.Hour}}
+	for _, l := range []*Limiter{nil, {}, {Rate: -1}, {Rate: 1, FullSpeed: day}} {
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if err := l.wait(ctx, 1<<20); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if d := time.Since(start); d > 50*time.Millisecond {
+			t.Errorf("unlimited %+v waited %v", l, d)
+		}
+	}
+
+	// 3 MiB at 10 MiB/s, by several readers sharing the limiter.
+	l := &Limiter{Rate: 10 << 20}
+	start := time.Now()
+	done := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() { done <- l.wait(ctx, 1<<20) }()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 250*time.Millisecond || d > time.Second {
+		t.Errorf("3 MiB at 10 MiB/s took %v, want about 300ms", d)
+	}
+
+	// A long wait ends with the context.
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := (&Limiter{Rate: 1}).wait(ctx, 1<<20); err != context.DeadlineExceeded {
+		t.Errorf("cancelled wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2024, 1, 1, h, m, 30, 0, time.Local) }
+	day := Window{Start: 12 * time.Hour, End: 13*time.Hour + 30*time.Minute}
+	night := Window{Start: 20 * time.Hour, End: 7 * time.Hour}
+	tests := []struct {
+		w    Window
+		t    time.Time
+		want bool
+	}{
+		{day, at(11, 59), false},
+		{day, at(12, 0), true},
+		{day, at(13, 29), true},
+		{day, at(13, 30), false},
+		{night, at(19, 59), false},
+		{night, at(20, 0), true},
+		{night, at(23, 59), true},
+		{night, at(0, 0), true},
+		{night, at(6, 59), true},
+		{night, at(7, 0), false},
+		{night, at(12, 0), false},
+		{Window{}, at(0, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.w.Contains(tt.t); got != tt.want {
+			t.Errorf("%+v.Contains(%s) = %v, want %v", tt.w, tt.t.Format("15:04:05"), got, tt.want)
+		}
+	}
+}
+
+func TestParseWindows(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []Window
+		err  bool
+	}{
+		{"", nil, false},
+		{"20:00-07:00", []Window{{20 * time.Hour, 7 * time.Hour}}, false},
+		{" 20:00 - 07:00 , 12:00-13:30,", []Window{{20 * time.Hour, 7 * time.Hour}, {12 * time.Hour, 13*time.Hour + 30*time.Minute}}, false},
+		{"0:05-23:59", []Window{{5 * time.Minute, 23*time.Hour + 59*time.Minute}}, false},
+		{"20:00", nil, true},
+		{"20:00-", nil, true},
+		{"24:00-07:00", nil, true},
+		{"20:60-07:00", nil, true},
+		{"8pm-7am", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseWindows(tt.in)
+		if (err != nil) != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseWindows(%q) = %v, %v; want %v, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"io"
+	"sync"
+
+	"github.com/mattchengg/susgo/firmware"
+)
+
+// remoteChunk is the unit in which Remote.ReadAt fetches and caches data. It
+// is large enough that archive/zip reading a central directory makes few
+// requests.
+const remoteChunk = 64 << 10
+
+// remoteCache is the number of chunks Remote keeps.
+const remoteCache = 8
+
+// Remote gives random access to the firmware on the server through ranged
+// requests, decrypted if the Downloader has a Key, so that parts of the zip
+// can be read without downloading all of it. Decryption is done by a
+// firmware.ReaderAt over the fetched ciphertext.
+type Remote struct {
+	d    *Downloader
+	ctx  context.Context
+	c    *firmware.Cipher
+	at   io.ReaderAt
+	size int64
+
+	mu     sync.Mutex
+	chunks map[int64][]byte
+	order  []int64
+}
+
+// Remote returns random access to the file of d. All its requests use ctx.
+// With a Key, the last block is fetched to find the size of the plaintext;
+// a wrong key is reported as ErrBadPadding.
+func (d *Downloader) Remote(ctx context.Context) (*Remote, error) {
+	c, err := d.cipher()
+	if err != nil {
+		return nil, err
+	}
+	r := &Remote{d: d, ctx: ctx, c: c, size: d.Size, chunks: map[int64][]byte{}}
+	r.at = rawRemote{r}
+	if c != nil {
+		if d.Size < aes.BlockSize || d.Size%aes.BlockSize != 0 {
+			return nil, ErrBadPadding
+		}
+		ra, err := firmware.NewDecryptReaderAt(r.at, d.Size, d.Key)
+		if err != nil {
+			return nil, err
+		}
+		r.at, r.size = ra, ra.Size()
+	}
+	return r, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *Remote) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads the plaintext at off, fetching and caching the chunks it
+// covers.
+func (r *Remote) ReadAt(p []byte, off int64) (int, error) {
+	return r.at.ReadAt(p, off)
+}
+
+// rawRemote reads the file of a Remote as stored on the server, through its
+// chunk cache.
+type rawRemote struct {
+	r *Remote
+}
+
+func (raw rawRemote) ReadAt(p []byte, off int64) (int, error) {
+	r := raw.r
+	n := 0
+	for n < len(p) {
+		if off >= r.d.Size {
+			return n, io.EOF
+		}
+		start := off - off%remoteChunk
+		data, err := r.chunk(start)
+		if err != nil {
+			return n, err
+		}
+		m := copy(p[n:], data[off-start:])
+		n += m
+		off += int64(m)
+	}
+	return n, nil
+}
+
+// chunk returns the stored bytes of the chunk at start.
+func (r *Remote) chunk(start int64) ([]byte, error) {
+	r.mu.Lock()
+	data, ok := r.chunks[start]
+	r.mu.Unlock()
+	if ok {
+		return data, nil
+	}
+	end := min(start+remoteChunk, r.d.Size)
+	body, err := r.open(start, end, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data = make([]byte, end-start)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.chunks[start]; !ok {
+		if len(r.order) == remoteCache {
+			delete(r.chunks, r.order[0])
+			r.order = r.order[1:]
+		}
+		r.chunks[start] = data
+		r.order = append(r.order, start)
+	}
+	return data, nil
+}
+
+// open requests the range [start, end) and returns it as a stream,
+// decrypted with c unless c is nil, in which case the range need not be
+// block-aligned.
+func (r *Remote) open(start, end int64, c *firmware.Cipher) (io.ReadCloser, error) {
+	resp, err := r.d.Client.DownloadRange(r.ctx, r.d.file(), start, end-1)
+	if err != nil {
+		return nil, err
+	}
+	r.d.noteResponse(resp)
+	return &remoteBody{r: r, c: c, body: resp.Body}, nil
+}
+
+// NewReader returns the n bytes of plaintext at off, streamed from a single
+// request. Unlike ReadAt it does not cache, so it suits reading a large zip
+// member once.
+func (r *Remote) NewReader(off, n int64) (io.ReadCloser, error) {
+	if off < 0 || n < 0 || off+n > r.size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	start := off &^ (aes.BlockSize - 1)
+	end := min((off+n+aes.BlockSize-1)&^(aes.BlockSize-1), r.d.Size)
+	if r.c == nil {
+		start, end = off, off+n
+	}
+	if n == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	body, err := r.open(start, end, r.c)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, body, off-start); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, n), body}, nil
+}
+
+// remoteBody decrypts a ranged response body with c, if not nil, and accounts for it in the
+// limiter and progress of the Downloader.
+type remoteBody struct {
+	r    *Remote
+	c    *firmware.Cipher
+	body io.ReadCloser
+	buf  []byte // decrypted bytes not yet returned
+	raw  []byte // trailing bytes of an incomplete block
+}
+
+func (b *remoteBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		chunk := make([]byte, max(len(p), aes.BlockSize)+len(b.raw))
+		n := copy(chunk, b.raw)
+		m, err := b.body.Read(chunk[n:])
+		if m > 0 {
+			b.r.d.progress(int64(m))
+			if werr := b.r.d.Limiter.wait(b.r.ctx, m); werr != nil {
+				return 0, werr
+			}
+		}
+		n += m
+		whole := n
+		if b.c != nil {
+			whole = n &^ (aes.BlockSize - 1)
+			b.c.Decrypt(chunk[:whole])
+		}
+		b.buf = chunk[:whole]
+		b.raw = append(b.raw[:0], chunk[whole:n]...)
+		if err == io.EOF && len(b.raw) > 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil && len(b.buf) == 0 {
+			return 0, err
+		}
+		if err != nil {
+			break
+		}
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+func (b *remoteBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,57 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+func TestRemote(t *testing.T) {
+	for _, decrypt := range []bool{false, true} {
+		d, srv := newTestDownloader(t)
+		want := srv.Ciphertext(testModel, testRegion, testVersion)
+		if decrypt {
+			d.Key = testKey(t, d)
+			want = srv.Plaintext(testModel, testRegion, testVersion)
+		}
+		r, err := d.Remote(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Size() != int64(len(want)) {
+			t.Fatalf("decrypt %v: Size = %d, want %d", decrypt, r.Size(), len(want))
+		}
+
+		// Unaligned ranges within a chunk, across chunks, and at the end.
+		size := r.Size()
+		ranges := []struct{ off, n int64 }{
+			{0, 1}, {5, 100}, {remoteChunk - 7, 30}, {3, remoteChunk + 5}, {size - 17, 17}, {size, 0},
+		}
+		for _, rg := range ranges {
+			p := make([]byte, rg.n)
+			if n, err := r.ReadAt(p, rg.off); n != len(p) || err != nil && err != io.EOF {
+				t.Errorf("decrypt %v: ReadAt(%d, %d) = %d, %v", decrypt, rg.off, rg.n, n, err)
+			} else if !bytes.Equal(p, want[rg.off:rg.off+rg.n]) {
+				t.Errorf("decrypt %v: ReadAt(%d, %d) differs from the file", decrypt, rg.off, rg.n)
+			}
+
+			body, err := r.NewReader(rg.off, rg.n)
+			if err != nil {
+				t.Errorf("decrypt %v: NewReader(%d, %d): %v", decrypt, rg.off, rg.n, err)
+				continue
+			}
+			got, err := io.ReadAll(body)
+			body.Close()
+			if err != nil || !bytes.Equal(got, want[rg.off:rg.off+rg.n]) {
+				t.Errorf("decrypt %v: NewReader(%d, %d) read %d bytes differing from the file, %v", decrypt, rg.off, rg.n, len(got), err)
+			}
+		}
+		if _, err := r.ReadAt(make([]byte, 1), size); err != io.EOF {
+			t.Errorf("decrypt %v: ReadAt past the end = %v, want EOF", decrypt, err)
+		}
+		if _, err := r.NewReader(size-1, 2); err == nil {
+			t.Errorf("decrypt %v: NewReader past the end succeeded", decrypt)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/mattchengg/susgo/fus"
+)
+
+// maxReconnects is how many times in a row a transfer reconnects after its
+// connection fails without delivering any data in between.
+const maxReconnects = 5
+
+// transfer downloads the bytes [start, end) of the file into w. When the
+// connection drops, ends early or stalls, the transfer continues from the
+// last byte written with a new ranged request, after the backoff of the
+// client's RetryPolicy so that a flapping server is not hammered. A session that expired in
+// the meantime is rejected by the server and renewed by the client, which
+// replays the nonce, BinaryInform and BinaryInit steps before retrying.
+func (d *Downloader) transfer(ctx context.Context, w io.Writer, start, end int64) error {
+	cw := &countWriter{w: w}
+	failures := 0
+	for {
+		pos := start + cw.n
+		retry, err := d.transferOnce(ctx, cw, pos, end)
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+		if start+cw.n > pos {
+			failures = 0
+		}
+		if failures++; failures > maxReconnects {
+			return err
+		}
+		if errors.Is(err, ErrStalled) {
+			d.stalls.Add(1)
+		}
+		if d.OnReconnect != nil {
+			d.OnReconnect(start+cw.n, err)
+		}
+		if err := d.Client.Retry().Wait(ctx, failures); err != nil {
+			return err
+		}
+	}
+}
+
+// transferOnce downloads from pos towards end over one connection,
+// reporting whether a failure may be overcome by reconnecting.
+func (d *Downloader) transferOnce(ctx context.Context, w io.Writer, pos, end int64) (retry bool, err error) {
+	rctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	resp, err := d.open(rctx, pos, end)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	d.noteResponse(resp)
+
+	r, stop := d.watch(resp.Body, cancel)
+	defer stop()
+	body := &responseBody{r: r, n: end - pos}
+	err = d.copy(ctx, w, body)
+	switch cause := context.Cause(rctx); {
+	case err == nil:
+		return false, nil
+	case errors.Is(cause, ErrStalled):
+		return true, cause
+	case err == body.err && isReadTimeout(err):
+		// The read timeout of the transport, if it is shorter than
+		// StallTimeout, catches an idle connection first.
+		return true, fmt.Errorf("%w: %w", ErrStalled, err)
+	}
+	return err == body.err && fus.IsTemporary(err), err
+}
+
+// isReadTimeout reports whether err is a connection's read deadline
+// expiring, as opposed to the download's context.
+func isReadTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout() && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// open requests the bytes [pos, end) of the file, the whole file without a
+// Range header if that is all of it.
+func (d *Downloader) open(ctx context.Context, pos, end int64) (*http.Response, error) {
+	if end == d.Size {
+		return d.Client.DownloadFile(ctx, d.file(), pos)
+	}
+	return d.Client.DownloadRange(ctx, d.file(), pos, end-1)
+}
+
+// responseBody reads the n bytes expected from a response, reporting an
+// early end as io.ErrUnexpectedEOF. It keeps the error it returned, so that
+// a failed read can be told from a failed write.
+type responseBody struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (b *responseBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.r.Read(p)
+	b.n -= int64(n)
+	if err == io.EOF && b.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
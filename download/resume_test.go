@@ -0,0 +1,101 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattchengg/susgo/fus"
+)
+
+func TestReconnect(t *testing.T) {
+	tests := []struct {
+		name        string
+		connections int
+		expire      bool
+	}{
+		{"dropped", 1, false},
+		{"expired session", 1, true},
+		{"segmented dropped", 4, false},
+		{"segmented expired session", 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, srv := newTestDownloader(t)
+			d.Connections = tt.connections
+			d.SegmentSize = 16 << 10
+			srv.Throttle(64 << 10)
+
+			// Drop the connections once part of the file has arrived.
+			var got atomic.Int64
+			var once sync.Once
+			d.Progress = func(n int64) {
+				if got.Add(n) >= 16<<10 {
+					once.Do(func() {
+						if tt.expire {
+							srv.ExpireSessions()
+						}
+						srv.Throttle(0)
+						srv.Disconnect()
+					})
+				}
+			}
+			var reconnects atomic.Int64
+			d.OnReconnect = func(offset int64, err error) {
+				reconnects.Add(1)
+				if errors.Is(err, ErrStalled) {
+					t.Errorf("reconnect at %d counted as a stall: %v", offset, err)
+				}
+			}
+
+			path := filepath.Join(t.TempDir(), "fw.zip.enc4")
+			if err := d.ToFile(context.Background(), path); err != nil {
+				t.Fatal(err)
+			}
+			checkOutput(t, path, srv.Ciphertext(testModel, testRegion, testVersion))
+			if n := reconnects.Load(); n < 1 || n > int64(tt.connections) {
+				t.Errorf("%d reconnects, want 1 to %d", n, tt.connections)
+			}
+			if n := d.Stalls(); n != 0 {
+				t.Errorf("Stalls() = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	const base = 200 * time.Millisecond
+	d, srv := newTestDownloader(t, fus.WithRetry(fus.RetryPolicy{MaxAttempts: 5, BaseDelay: base, MaxDelay: base}))
+	srv.Throttle(64 << 10)
+	var once sync.Once
+	d.Progress = func(n int64) {
+		once.Do(func() {
+			srv.Throttle(0)
+			srv.Disconnect()
+		})
+	}
+	var reconnected time.Time
+	d.OnReconnect = func(int64, error) { reconnected = time.Now() }
+	var resumed time.Duration
+	d.OnResponse = func(*http.Response) {
+		if !reconnected.IsZero() && resumed == 0 {
+			resumed = time.Since(reconnected)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "fw.zip.enc4")
+	if err := d.ToFile(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	if reconnected.IsZero() {
+		t.Fatal("no reconnect")
+	}
+	if resumed < base/2 {
+		t.Errorf("reconnected after %v, want at least %v", resumed, base/2)
+	}
+}
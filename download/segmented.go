@@ -0,0 +1,158 @@
+package download
+
+import (
+	"context"
+	"crypto/aes"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	minSegmentSize    = 1 << 20
+	segmentsPerConn   = 4
+	stateSaveInterval = time.Second
+)
+
+// segmentState splits the file into segments, counting the first have
+// bytes, left by an earlier single-connection download, as done.
+func (d *Downloader) segmentState(have int64) *state {
+	st := d.newState()
+	segSize := d.segmentSize()
+	for start := int64(0); start < d.Size; start += segSize {
+		s := &segment{Start: start, End: min(start+segSize, d.Size)}
+		s.Done = max(0, min(have-start, s.End-start))
+		st.Segments = append(st.Segments, s)
+	}
+	return st
+}
+
+// segmentSize returns the segment size, a whole number of cipher blocks;
+// see firmware.Cipher.
+func (d *Downloader) segmentSize() int64 {
+	size := d.SegmentSize
+	if size <= 0 {
+		conns := int64(max(d.Connections, 1))
+		size = max(minSegmentSize, (d.Size+conns*segmentsPerConn-1)/(conns*segmentsPerConn))
+	}
+	return (size + aes.BlockSize - 1) &^ (aes.BlockSize - 1)
+}
+
+func (d *Downloader) segmented(ctx context.Context, path string, st *state) (err error) {
+	o, err := d.openOutput(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := o.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	if err := o.syncCopy(ctx); err != nil {
+		return err
+	}
+
+	info, err := o.Stat()
+	if err != nil {
+		return err
+	}
+	if st == nil || st.Segments == nil {
+		st = d.segmentState(d.blockAlign(min(info.Size(), d.Size)))
+	}
+	if info.Size() != d.Size {
+		if err := o.Truncate(d.Size); err != nil {
+			return err
+		}
+	}
+	if err := st.save(path); err != nil {
+		return err
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// Persist progress periodically so an interrupted run resumes each
+	// segment close to where it stopped.
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		ticker := time.NewTicker(stateSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				st.save(path)
+			}
+		}
+	}()
+
+	queue := make(chan *segment, len(st.Segments))
+	for _, s := range st.Segments {
+		if s.Done < s.End-s.Start {
+			queue <- s
+		}
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(d.Connections, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range queue {
+				if err := d.fetchSegment(ctx, o, st, s); err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	cancel(nil)
+	<-saved
+
+	if err := context.Cause(ctx); err != nil && err != context.Canceled {
+		st.save(path)
+		return err
+	}
+	if st.done() != d.Size {
+		st.save(path)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return io.ErrUnexpectedEOF
+	}
+	if err := o.Sync(); err != nil {
+		return err
+	}
+	// Segments arrive out of order, so the file is hashed once complete.
+	return d.complete(parent, path)
+}
+
+func (d *Downloader) fetchSegment(ctx context.Context, o *output, st *state, s *segment) error {
+	st.mu.Lock()
+	start, end := s.Start+s.Done, s.End
+	st.mu.Unlock()
+
+	return d.transfer(ctx, &segmentWriter{o: o, st: st, s: s, off: start}, start, end)
+}
+
+// segmentWriter writes a segment in place and records its progress.
+type segmentWriter struct {
+	o   *output
+	st  *state
+	s   *segment
+	off int64
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	n, err := w.o.WriteAt(p, w.off)
+	w.off += int64(n)
+	w.st.mu.Lock()
+	w.s.Done += int64(n)
+	w.st.mu.Unlock()
+	return n, err
+}
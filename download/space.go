@@ -0,0 +1,73 @@
+package download
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// ErrNoSpace is returned, wrapped in a *SpaceError, when a filesystem has
+// too little free space for an operation.
+var ErrNoSpace = errors.New("not enough disk space")
+
+// SpaceError reports the space an operation needs on the filesystem of Dir
+// and the space available there.
+type SpaceError struct {
+	Dir       string
+	Required  int64
+	Available int64
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("not enough disk space in %s: %s required, %s available",
+		e.Dir, FormatSize(e.Required), FormatSize(e.Available))
+}
+
+func (e *SpaceError) Unwrap() error { return ErrNoSpace }
+
+// CheckSpace returns a *SpaceError if the filesystem holding path, which
+// need not exist yet, has less than required bytes free. Where free space
+// cannot be queried it returns nil.
+func CheckSpace(path string, required int64) error {
+	dir := filepath.Dir(path)
+	avail, err := freeSpace(dir)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if avail < required {
+		return &SpaceError{Dir: dir, Required: required, Available: avail}
+	}
+	return nil
+}
+
+// Remaining returns how many bytes the download into path still has to
+// write to disk, counting the encrypted copy kept next to a file decrypted
+// on the fly.
+func (d *Downloader) Remaining(path string) (int64, error) {
+	done, err := d.Status(path)
+	if err != nil {
+		return 0, err
+	}
+	n := d.Size - done
+	if d.Key != nil && d.EncryptedPath != "" {
+		n *= 2
+	}
+	return n, nil
+}
+
+// FormatSize formats the byte count b with a binary unit, e.g. 1.5MB.
+func FormatSize(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%dB", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(b)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,66 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckSpace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "not-yet", "..", "fw.zip")
+	if err := CheckSpace(path, 0); err != nil {
+		t.Errorf("CheckSpace(0) = %v", err)
+	}
+	err := CheckSpace(path, 1<<62)
+	var se *SpaceError
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip(err)
+	}
+	if !errors.As(err, &se) || !errors.Is(err, ErrNoSpace) {
+		t.Fatalf("CheckSpace(1<<62) = %v, want a *SpaceError", err)
+	}
+	if se.Dir != filepath.Dir(path) || se.Required != 1<<62 || se.Available <= 0 {
+		t.Errorf("SpaceError = %+v", se)
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	d, want, path := cancelledDownload(t, 1)
+	have, err := d.Status(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.Remaining(path); err != nil || n != d.Size-have {
+		t.Errorf("Remaining of a partial download = %d, %v; want %d", n, err, d.Size-have)
+	}
+	if n, err := d.Remaining(filepath.Join(t.TempDir(), "new.zip")); err != nil || n != d.Size {
+		t.Errorf("Remaining of a new download = %d, %v; want %d", n, err, d.Size)
+	}
+
+	// Decrypted on the fly with the encrypted copy kept, both are written.
+	enc := &Downloader{Size: d.Size, Key: make([]byte, 16), EncryptedPath: filepath.Join(t.TempDir(), "fw.zip.enc4")}
+	if n, err := enc.Remaining(filepath.Join(t.TempDir(), "fw.zip")); err != nil || n != 2*d.Size {
+		t.Errorf("Remaining with an encrypted copy = %d, %v; want %d", n, err, 2*d.Size)
+	}
+
+	if err := d.ToFile(context.Background(), path); err != nil {
+		t.Fatal(err)
+	}
+	checkOutput(t, path, want)
+	if n, err := d.Remaining(path); err != nil || n != 0 {
+		t.Errorf("Remaining of a finished download = %d, %v; want 0", n, err)
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	for b, want := range map[int64]string{
+		0: "0B", 1023: "1023B", 1024: "1.0KB", 1536: "1.5KB",
+		5 << 20: "5.0MB", 3 << 30: "3.0GB", 1 << 40: "1.0TB",
+	} {
+		if got := FormatSize(b); got != want {
+			t.Errorf("FormatSize(%d) = %q, want %q", b, got, want)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultStallWindow is the period over which MinSpeed is measured when
+// StallTimeout is not set.
+const DefaultStallWindow = time.Minute
+
+// ErrStalled is the cause of reconnecting a connection that received too
+// little data; see Downloader.StallTimeout and MinSpeed.
+var ErrStalled = errors.New("connection stalled")
+
+// watchdog measures the reads of one response body and cancels its request
+// when they stall.
+type watchdog struct {
+	r        io.Reader
+	cancel   context.CancelCauseFunc
+	timeout  time.Duration
+	window   time.Duration
+	minSpeed int64
+	done     chan struct{}
+
+	mu      sync.Mutex
+	reading bool
+	start   time.Time     // of the read in progress
+	mark    time.Time     // up to which the read in progress is counted in busy
+	busy    time.Duration // spent waiting for data in the current window
+	n       int64         // bytes received in the current window
+}
+
+// watch returns body wrapped in a watchdog that calls cancel with an error
+// wrapping ErrStalled, or body itself if stall detection is off. The
+// returned function stops the watchdog.
+func (d *Downloader) watch(body io.Reader, cancel context.CancelCauseFunc) (io.Reader, func()) {
+	if d.StallTimeout <= 0 && d.MinSpeed <= 0 {
+		return body, func() {}
+	}
+	wd := &watchdog{
+		r:        body,
+		cancel:   cancel,
+		timeout:  d.StallTimeout,
+		window:   d.StallTimeout,
+		minSpeed: d.MinSpeed,
+		done:     make(chan struct{}),
+		mark:     time.Now(),
+	}
+	if wd.window <= 0 {
+		wd.window = DefaultStallWindow
+	}
+	go wd.run()
+	return wd, func() { close(wd.done) }
+}
+
+func (wd *watchdog) Read(p []byte) (int, error) {
+	now := time.Now()
+	wd.mu.Lock()
+	wd.reading, wd.start, wd.mark = true, now, now
+	wd.mu.Unlock()
+
+	n, err := wd.r.Read(p)
+
+	now = time.Now()
+	wd.mu.Lock()
+	wd.reading = false
+	wd.busy += now.Sub(wd.mark)
+	wd.n += int64(n)
+	wd.mu.Unlock()
+	return n, err
+}
+
+func (wd *watchdog) run() {
+	t := time.NewTicker(min(wd.window/10, time.Second))
+	defer t.Stop()
+	for {
+		select {
+		case <-wd.done:
+			return
+		case now := <-t.C:
+			if err := wd.check(now); err != nil {
+				wd.cancel(err)
+				return
+			}
+		}
+	}
+}
+
+// check reports a stall at now. Only time spent waiting for data counts
+// towards the speed, so that a Limiter slowing the reads down is not
+// mistaken for a slow connection.
+func (wd *watchdog) check(now time.Time) error {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	busy := wd.busy
+	if wd.reading {
+		if idle := now.Sub(wd.start); wd.timeout > 0 && idle >= wd.timeout {
+			return fmt.Errorf("%w: no data for %s", ErrStalled, idle.Round(time.Second))
+		}
+		busy += now.Sub(wd.mark)
+	}
+	if busy < wd.window {
+		return nil
+	}
+	if speed := float64(wd.n) / busy.Seconds(); wd.minSpeed > 0 && speed < float64(wd.minSpeed) {
+		return fmt.Errorf("%w: %.0f bytes/s over %s, below %d", ErrStalled, speed, busy.Round(time.Second), wd.minSpeed)
+	}
+	wd.busy, wd.n, wd.mark = 0, 0, now
+	return nil
+}
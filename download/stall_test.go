@@ -0,0 +1,63 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattchengg/susgo/fus"
+	"github.com/mattchengg/susgo/transport"
+)
+
+func TestStall(t *testing.T) {
+	hc, err := transport.NewClient(transport.Config{ReadTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		opts     []fus.Option
+		rate     int64 // of the first connection
+		timeout  time.Duration
+		minSpeed int64
+		timedOut bool // stalled by the read timeout of the transport
+	}{
+		{"too slow", nil, 16 << 10, 200 * time.Millisecond, 1 << 20, false},
+		{"read timeout", []fus.Option{fus.WithHTTPClient(hc)}, 1, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, srv := newTestDownloader(t, tt.opts...)
+			d.StallTimeout, d.MinSpeed = tt.timeout, tt.minSpeed
+			srv.Throttle(tt.rate)
+
+			var reconnects atomic.Int64
+			d.OnReconnect = func(offset int64, err error) {
+				reconnects.Add(1)
+				// Let the abandoned response end, and the next run at
+				// full speed.
+				srv.Disconnect()
+				srv.Throttle(0)
+				var netErr net.Error
+				if !errors.Is(err, ErrStalled) {
+					t.Errorf("reconnect error = %v, want one wrapping %v", err, ErrStalled)
+				} else if timedOut := errors.As(err, &netErr) && netErr.Timeout(); timedOut != tt.timedOut {
+					t.Errorf("reconnect error = %v, read timeout %v, want %v", err, timedOut, tt.timedOut)
+				}
+			}
+
+			path := filepath.Join(t.TempDir(), "fw.zip.enc4")
+			if err := d.ToFile(context.Background(), path); err != nil {
+				t.Fatal(err)
+			}
+			checkOutput(t, path, srv.Ciphertext(testModel, testRegion, testVersion))
+			if n := reconnects.Load(); n != 1 || d.Stalls() != 1 {
+				t.Errorf("%d reconnects and %d stalls, want 1 of each", n, d.Stalls())
+			}
+		})
+	}
+}
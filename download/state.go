@@ -0,0 +1,195 @@
+package download
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// StatePath returns the path of the state file kept next to a partial
+// download of path.
+func StatePath(path string) string {
+	return path + ".susgo.json"
+}
+
+// state records which firmware a partial download belongs to and how far it
+// got. A single-connection download records the hash state of the bytes
+// written so far; a segmented one records the progress of every segment.
+type state struct {
+	Model      string `json:"model"`
+	Region     string `json:"region"`
+	Version    string `json:"version"`
+	BinaryName string `json:"binary_name"`
+	ModelPath  string `json:"model_path"`
+	Size       int64  `json:"size"`
+	Decrypted  bool   `json:"decrypted,omitempty"`
+
+	Hash     *hashState `json:"hash,omitempty"`
+	Segments []*segment `json:"segments,omitempty"`
+
+	mu sync.Mutex
+}
+
+// hashState is a serialized hasher covering the first Offset bytes.
+type hashState struct {
+	Offset int64  `json:"offset"`
+	MD5    []byte `json:"md5"`
+	CRC32  []byte `json:"crc32"`
+}
+
+// segment is the byte range [Start, End) of which the first Done bytes have
+// been written.
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Done  int64 `json:"done"`
+}
+
+func loadState(path string) (*state, error) {
+	data, err := os.ReadFile(StatePath(path))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st := &state{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// save writes the state file atomically.
+func (st *state) save(path string) error {
+	st.mu.Lock()
+	data, err := json.Marshal(st)
+	st.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := StatePath(path) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, StatePath(path))
+}
+
+func (st *state) done() int64 {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var n int64
+	for _, s := range st.Segments {
+		n += s.Done
+	}
+	return n
+}
+
+// newState returns an empty state identifying the firmware of d.
+func (d *Downloader) newState() *state {
+	return &state{
+		Model:      d.Model,
+		Region:     d.Region,
+		Version:    d.Version,
+		BinaryName: d.BinaryName,
+		ModelPath:  d.ModelPath,
+		Size:       d.Size,
+		Decrypted:  d.Key != nil,
+	}
+}
+
+// mismatch returns why st does not describe the download of d, or "".
+func (d *Downloader) mismatch(st *state) string {
+	want := d.newState()
+	for _, f := range []struct{ name, got, want string }{
+		{"model", st.Model, want.Model},
+		{"region", st.Region, want.Region},
+		{"version", st.Version, want.Version},
+		{"BINARY_NAME", st.BinaryName, want.BinaryName},
+		{"MODEL_PATH", st.ModelPath, want.ModelPath},
+	} {
+		if f.got != f.want {
+			return fmt.Sprintf("it belongs to %s %q, not %q", f.name, f.got, f.want)
+		}
+	}
+	if st.Size != want.Size {
+		return fmt.Sprintf("it was started for %d bytes, not %d", st.Size, want.Size)
+	}
+	if st.Decrypted != want.Decrypted {
+		return "it was started with the other decryption mode"
+	}
+	return ""
+}
+
+// resumeState inspects partial, the partial download of path. It returns
+// the validated state, if any, and the size of the file. If the file cannot
+// be resumed, reason says why and the download has to start over.
+func (d *Downloader) resumeState(path, partial string) (st *state, size int64, reason string, err error) {
+	info, err := os.Stat(partial)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, "", nil
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+	size = info.Size()
+
+	st, err = loadState(path)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return nil, size, "its resume state is unreadable", nil
+	}
+	if err != nil {
+		return nil, 0, "", err
+	}
+	switch {
+	case st == nil && (size == 0 || size == d.Size):
+		// Nothing yet, or a complete file to be verified.
+		return nil, size, "", nil
+	case st == nil:
+		return nil, size, "there is no resume state for it", nil
+	}
+	if reason := d.mismatch(st); reason != "" {
+		return nil, size, reason, nil
+	}
+	switch {
+	case st.Segments != nil && size != d.Size:
+		return nil, size, fmt.Sprintf("the segmented file is %d bytes, expected %d", size, d.Size), nil
+	case st.Segments == nil && size > d.Size:
+		return nil, size, fmt.Sprintf("the file is %d bytes, larger than %d", size, d.Size), nil
+	case st.Hash != nil && size < st.Hash.Offset:
+		return nil, size, fmt.Sprintf("the file is %d bytes, shorter than the %d recorded", size, st.Hash.Offset), nil
+	}
+	return st, size, "", nil
+}
+
+// snapshot records the state of h.
+func (h *hasher) snapshot() (*hashState, error) {
+	md5State, err := h.md5.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	crcState, err := h.crc.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &hashState{Offset: h.n, MD5: md5State, CRC32: crcState}, nil
+}
+
+// restoreHasher returns a hasher continuing from hs.
+func restoreHasher(hs *hashState) (*hasher, error) {
+	h := newHasher()
+	if err := h.md5.(encoding.BinaryUnmarshaler).UnmarshalBinary(hs.MD5); err != nil {
+		return nil, err
+	}
+	if err := h.crc.(encoding.BinaryUnmarshaler).UnmarshalBinary(hs.CRC32); err != nil {
+		return nil, err
+	}
+	h.n = hs.Offset
+	return h, nil
+}
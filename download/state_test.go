@@ -0,0 +1,120 @@
+package download
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// cancelledDownload starts downloading the firmware of a new test server
+// over connections and cancels it once part of the file has arrived.
+func cancelledDownload(t *testing.T, connections int) (*Downloader, []byte, string) {
+	t.Helper()
+	d, srv := newTestDownloader(t)
+	d.Connections = connections
+	d.SegmentSize = 16 << 10
+	srv.Throttle(64 << 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var got atomic.Int64
+	d.Progress = func(n int64) {
+		if got.Add(n) >= 16<<10 {
+			cancel()
+		}
+	}
+	path := filepath.Join(t.TempDir(), "fw.zip.enc4")
+	if err := d.ToFile(ctx, path); err != context.Canceled {
+		t.Fatalf("cancelled ToFile = %v, want %v", err, context.Canceled)
+	}
+	srv.Throttle(0)
+	d.Progress = nil
+	return d, srv.Ciphertext(testModel, testRegion, testVersion), path
+}
+
+func TestResume(t *testing.T) {
+	for _, conns := range []int{1, 4} {
+		d, want, path := cancelledDownload(t, conns)
+		have, err := d.Status(path)
+		if err != nil || have <= 0 || have >= d.Size {
+			t.Fatalf("%d connections: Status after cancel = %d, %v; want a partial download", conns, have, err)
+		}
+
+		var fetched atomic.Int64
+		d.Progress = func(n int64) { fetched.Add(n) }
+		d.OnRestart = func(reason string) { t.Errorf("%d connections: restarted: %s", conns, reason) }
+		if err := d.ToFile(context.Background(), path); err != nil {
+			t.Fatal(err)
+		}
+		checkOutput(t, path, want)
+		if n := fetched.Load(); n != d.Size-have {
+			t.Errorf("%d connections: resumed download fetched %d bytes, want %d", conns, n, d.Size-have)
+		}
+	}
+}
+
+// editState rewrites the state file of path with edit applied.
+func editState(t *testing.T, path string, edit func(st *state)) {
+	t.Helper()
+	st, err := loadState(path)
+	if err != nil || st == nil {
+		t.Fatalf("loadState = %v, %v", st, err)
+	}
+	edit(st)
+	if err := st.save(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeStateMismatch(t *testing.T) {
+	const otherVersion = "S928BXXS4BYG2/S928BOXM4BYG2/S928BXXS4BYG2/S928BXXS4BYG2"
+	tests := []struct {
+		name        string
+		connections int
+		edit        func(st *state)         // applied to the state file
+		damage      func(path string) error // applied to the files otherwise
+		reason      string
+	}{
+		{"version", 1, func(st *state) { st.Version = otherVersion }, nil, "version"},
+		{"segmented version", 4, func(st *state) { st.Version = otherVersion }, nil, "version"},
+		{"binary name", 1, func(st *state) { st.BinaryName = "other.zip.enc4" }, nil, "BINARY_NAME"},
+		{"size", 4, func(st *state) { st.Size += 16 }, nil, "started for"},
+		{"decryption mode", 1, func(st *state) { st.Decrypted = true }, nil, "decryption mode"},
+		{"truncated", 1, nil, func(path string) error { return os.Truncate(TempPath(path), 16) }, "shorter than"},
+		{"segmented truncated", 4, nil, func(path string) error { return os.Truncate(TempPath(path), 16) }, "segmented file is 16 bytes"},
+		{"unreadable state", 1, nil, func(path string) error { return os.WriteFile(StatePath(path), []byte("{"), 0644) }, "unreadable"},
+		{"no state", 1, nil, func(path string) error { return os.Remove(StatePath(path)) }, "no resume state"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, want, path := cancelledDownload(t, tt.connections)
+			if tt.edit != nil {
+				editState(t, path, tt.edit)
+			}
+			if tt.damage != nil {
+				if err := tt.damage(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if have, err := d.Status(path); err != nil || have != 0 {
+				t.Errorf("Status = %d, %v; want 0", have, err)
+			}
+			if _, err := os.Stat(TempPath(path)); err != nil {
+				t.Fatalf("Status removed the partial file: %v", err)
+			}
+
+			var reasons []string
+			d.OnRestart = func(reason string) { reasons = append(reasons, reason) }
+			if err := d.ToFile(context.Background(), path); err != nil {
+				t.Fatal(err)
+			}
+			checkOutput(t, path, want)
+			if len(reasons) != 1 || !strings.Contains(reasons[0], tt.reason) {
+				t.Errorf("restart reasons = %q, want one mentioning %q", reasons, tt.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package download
+
+import (
+	"context"
+	"io"
+
+	"github.com/mattchengg/susgo/firmware"
+)
+
+// ToWriter downloads the whole file into w over a single connection, for
+// example to stream it to stdout. With Key set, w receives the plaintext
+// without its padding. Nothing is stored, so an interrupted download cannot
+// be resumed later, though a dropped connection is, and Connections is
+// ignored. The file is verified once it has been streamed; when decrypting,
+// the last block is only written if verification succeeds.
+func (d *Downloader) ToWriter(ctx context.Context, w io.Writer) error {
+	if d.Key == nil {
+		h := newHasher()
+		if err := d.transfer(ctx, io.MultiWriter(h, w), 0, d.Size); err != nil {
+			return err
+		}
+		return d.check(h.digest())
+	}
+
+	// The ciphertext goes through a pipe to a firmware.Reader, which holds
+	// the last block back until the pipe is closed, and fails instead if it
+	// is closed with an error.
+	pr, pw := io.Pipe()
+	r, err := firmware.NewDecryptReader(pr, d.Key)
+	if err != nil {
+		return err
+	}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w, r)
+		pr.CloseWithError(err)
+		copied <- err
+	}()
+	h := newHasher()
+	err = d.transfer(ctx, io.MultiWriter(h, pw), 0, d.Size)
+	if err == nil {
+		err = d.check(h.digest())
+	}
+	if err != nil {
+		pw.CloseWithError(err)
+	} else {
+		pw.Close()
+	}
+	if cerr := <-copied; err == nil {
+		err = cerr
+	}
+	return err
+}
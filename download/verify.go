@@ -0,0 +1,210 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/mattchengg/susgo/firmware"
+)
+
+// ErrIntegrity is returned, wrapped in an *IntegrityError, when a downloaded
+// file does not match the size or checksums announced by the server.
+var ErrIntegrity = errors.New("integrity check failed")
+
+// IntegrityError reports which check a downloaded file failed.
+type IntegrityError struct {
+	Check string // "size", "CRC-32" or "MD5"
+	Want  string
+	Got   string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("%s mismatch: expected %s, got %s", e.Check, e.Want, e.Got)
+}
+
+func (e *IntegrityError) Unwrap() error { return ErrIntegrity }
+
+// Digest holds the size and checksums of a file.
+type Digest struct {
+	Size  int64
+	MD5   []byte
+	CRC32 uint32
+}
+
+// hasher computes a Digest of everything written to it.
+type hasher struct {
+	md5 hash.Hash
+	crc hash.Hash32
+	n   int64
+}
+
+func newHasher() *hasher {
+	return &hasher{md5: md5.New(), crc: crc32.NewIEEE()}
+}
+
+func (h *hasher) Write(p []byte) (int, error) {
+	h.md5.Write(p)
+	h.crc.Write(p)
+	h.n += int64(len(p))
+	return len(p), nil
+}
+
+func (h *hasher) digest() Digest {
+	return Digest{Size: h.n, MD5: h.md5.Sum(nil), CRC32: h.crc.Sum32()}
+}
+
+// hashPrefix feeds the next n bytes of r to h.
+func hashPrefix(ctx context.Context, h *hasher, r io.Reader, n int64) error {
+	buf := make([]byte, 1<<20)
+	r = io.LimitReader(r, n)
+	want := h.n + n
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m, err := r.Read(buf)
+		h.Write(buf[:m])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if h.n != want {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// noteResponse records the Content-MD5 of a download response. FUS sends
+// the digest of the whole file, also on ranged responses, but under RFC 1864
+// it is that of the body, so only the digest of a response that covers the
+// whole file is relied on.
+func (d *Downloader) noteResponse(resp *http.Response) {
+	sum, err := base64.StdEncoding.DecodeString(resp.Header.Get("Content-MD5"))
+	if err == nil && len(sum) == md5.Size && coversFile(resp, d.Size) {
+		d.mu.Lock()
+		if d.contentMD5 == nil {
+			d.contentMD5 = sum
+		}
+		d.mu.Unlock()
+	}
+	if d.OnResponse != nil {
+		d.OnResponse(resp)
+	}
+}
+
+// coversFile reports whether resp carries all size bytes of the file.
+func coversFile(resp *http.Response, size int64) bool {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true
+	case http.StatusPartialContent:
+		var start, end, total int64
+		_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		return err == nil && start == 0 && end == size-1 && total == size
+	}
+	return false
+}
+
+// ContentMD5 returns the MD5 of the whole file announced by the server, or
+// nil if no response covering the whole file has been seen yet.
+func (d *Downloader) ContentMD5() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.contentMD5
+}
+
+// Verify hashes the complete file at path, re-encrypting it if it was
+// decrypted on the fly, and checks it against d.Size, d.CRC32 and the
+// server's Content-MD5. A finished decrypted file, shorter than d.Size, has
+// its padding restored to re-encrypt the last block. If no response covering the whole
+// file has been seen yet, the headers of one are fetched for the MD5, so
+// the session must already be initialized.
+func (d *Downloader) Verify(ctx context.Context, path string) error {
+	if err := d.fetchMD5(ctx); err != nil {
+		return err
+	}
+
+	c, err := d.cipher()
+	if err != nil {
+		return err
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	whole := info.Size()
+	var last []byte
+	if c != nil && whole < d.Size {
+		whole &^= aes.BlockSize - 1
+		last = make([]byte, info.Size()-whole)
+		if _, err := fd.ReadAt(last, whole); err != nil {
+			return err
+		}
+		last = firmware.Pad(last)
+		c.Encrypt(last)
+	}
+	h := newHasher()
+	if err := hashPrefix(ctx, h, &output{File: fd, c: c}, whole); err != nil {
+		return err
+	}
+	h.Write(last)
+	return d.check(h.digest())
+}
+
+// fetchMD5 requests the whole file and reads the MD5 from the response
+// headers, unless a response covering the whole file has been seen.
+func (d *Downloader) fetchMD5(ctx context.Context) error {
+	if d.ContentMD5() != nil || d.Client == nil {
+		return nil
+	}
+	resp, err := d.Client.DownloadFile(ctx, d.file(), 0)
+	if err != nil {
+		return err
+	}
+	d.noteResponse(resp)
+	return resp.Body.Close()
+}
+
+// check compares sum with what the server announced.
+func (d *Downloader) check(sum Digest) error {
+	d.mu.Lock()
+	d.sum = sum
+	want := d.contentMD5
+	d.mu.Unlock()
+
+	if sum.Size != d.Size {
+		return &IntegrityError{Check: "size", Want: fmt.Sprint(d.Size), Got: fmt.Sprint(sum.Size)}
+	}
+	if d.CRC32 != 0 && sum.CRC32 != d.CRC32 {
+		return &IntegrityError{Check: "CRC-32", Want: fmt.Sprintf("%08x", d.CRC32), Got: fmt.Sprintf("%08x", sum.CRC32)}
+	}
+	if want != nil && !bytes.Equal(sum.MD5, want) {
+		return &IntegrityError{Check: "MD5", Want: fmt.Sprintf("%x", want), Got: fmt.Sprintf("%x", sum.MD5)}
+	}
+	return nil
+}
+
+// Sum returns the digest computed by the last ToFile or Verify call.
+func (d *Downloader) Sum() Digest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sum
+}
@@ -0,0 +1,132 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestToFileVerificationFailure(t *testing.T) {
+	d, srv := newTestDownloader(t)
+	path := filepath.Join(t.TempDir(), "fw.zip.enc4")
+
+	// A complete file without state is verified; flip one byte of it.
+	data := bytes.Clone(srv.Ciphertext(testModel, testRegion, testVersion))
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(TempPath(path), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := d.ToFile(context.Background(), path)
+	var ierr *IntegrityError
+	if !errors.As(err, &ierr) || !errors.Is(err, ErrIntegrity) {
+		t.Fatalf("ToFile = %v, want an *IntegrityError", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("unverified file renamed into place: %v", err)
+	}
+	if _, err := os.Stat(TempPath(path)); err != nil {
+		t.Errorf("unverified file not kept: %v", err)
+	}
+}
+
+func TestToFileFinishedFile(t *testing.T) {
+	for _, decrypt := range []bool{false, true} {
+		for _, corrupt := range []bool{false, true} {
+			d, srv := newTestDownloader(t)
+			want := srv.Ciphertext(testModel, testRegion, testVersion)
+			if decrypt {
+				d.Key = testKey(t, d)
+				want = srv.Plaintext(testModel, testRegion, testVersion)
+			}
+			var restarts []string
+			d.OnRestart = func(reason string) { restarts = append(restarts, reason) }
+
+			// A file of the right size at the final path, as left by an
+			// earlier run or put there by hand.
+			path := filepath.Join(t.TempDir(), "fw.zip")
+			data := bytes.Clone(want)
+			if corrupt {
+				data[len(data)/2] ^= 1
+			}
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.ToFile(context.Background(), path); err != nil {
+				t.Fatalf("decrypt %v, corrupt %v: %v", decrypt, corrupt, err)
+			}
+			checkOutput(t, path, want)
+			if corrupt != (len(restarts) == 1) {
+				t.Errorf("decrypt %v, corrupt %v: restarts = %q", decrypt, corrupt, restarts)
+			}
+		}
+	}
+}
+
+// TestContentMD5 states the assumption about Content-MD5 that fustest
+// shares with FUS: ranged responses carry the MD5 of the whole file rather
+// than of their body. It is only trusted on a response covering the whole
+// file.
+func TestContentMD5(t *testing.T) {
+	d, srv := newTestDownloader(t)
+	ctx := context.Background()
+	sum := md5.Sum(srv.Ciphertext(testModel, testRegion, testVersion))
+
+	resp, err := d.Client.DownloadRange(ctx, d.file(), 0, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Content-MD5"); got != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("ranged Content-MD5 = %q, want the MD5 of the whole file", got)
+	}
+	d.noteResponse(resp)
+	if got := d.ContentMD5(); got != nil {
+		t.Errorf("ContentMD5() = %x after a ranged response, want nil", got)
+	}
+
+	if err := d.Verify(ctx, writeTemp(t, srv.Ciphertext(testModel, testRegion, testVersion))); err != nil {
+		t.Fatal(err)
+	}
+	if got := d.ContentMD5(); !bytes.Equal(got, sum[:]) {
+		t.Errorf("ContentMD5() = %x after Verify, want %x", got, sum)
+	}
+}
+
+// writeTemp writes data to a temporary file and returns its path.
+func writeTemp(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCoversFile(t *testing.T) {
+	tests := []struct {
+		status       int
+		contentRange string
+		want         bool
+	}{
+		{http.StatusOK, "", true},
+		{http.StatusPartialContent, "bytes 0-99/100", true},
+		{http.StatusPartialContent, "bytes 1-99/100", false},
+		{http.StatusPartialContent, "bytes 0-98/100", false},
+		{http.StatusPartialContent, "bytes 0-99/200", false},
+		{http.StatusPartialContent, "", false},
+		{http.StatusRequestedRangeNotSatisfiable, "bytes */100", false},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{StatusCode: tt.status, Header: http.Header{}}
+		resp.Header.Set("Content-Range", tt.contentRange)
+		if got := coversFile(resp, 100); got != tt.want {
+			t.Errorf("coversFile(%d, %q) = %v, want %v", tt.status, tt.contentRange, got, tt.want)
+		}
+	}
+}
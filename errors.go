@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/mattchengg/susgo/download"
+	"github.com/mattchengg/susgo/firmware"
+	"github.com/mattchengg/susgo/fota"
+	"github.com/mattchengg/susgo/fus"
+)
+
+// Exit codes, so scripts can tell failure classes apart.
+const (
+	exitError       = 1
+	exitNetwork     = 3
+	exitBadIMEI     = 4
+	exitNotFound    = 5
+	exitAuth        = 6
+	exitServerBusy  = 7
+	exitIntegrity   = 8
+	exitNoSpace     = 9
+	exitWrongKey    = 10
+	exitInterrupted = 130
+)
+
+// reportError prints err with a hint for the known failure classes and
+// returns the matching exit code.
+func reportError(err error) int {
+	code, hint := classifyError(err)
+	if code == exitInterrupted {
+		fmt.Fprintln(os.Stderr, "\nInterrupted.")
+		return code
+	}
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	if hint != "" {
+		fmt.Fprintln(os.Stderr, hint)
+	}
+	return code
+}
+
+func classifyError(err error) (int, string) {
+	var netErr net.Error
+	var urlErr *url.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return exitInterrupted, ""
+	case errors.Is(err, fus.ErrBadIMEI):
+		return exitBadIMEI, "The server rejected the IMEI/serial; check -i or -s."
+	case errors.Is(err, fus.ErrUnknownModel), errors.Is(err, fota.ErrNotFound):
+		return exitNotFound, "Check the model (-m) and region (-r)."
+	case errors.Is(err, fus.ErrNotFound), errors.Is(err, fota.ErrNoFirmware):
+		return exitNotFound, "No firmware is available for this model, region and version."
+	case errors.Is(err, fus.ErrAuth):
+		return exitAuth, "The server refused the session; try again later."
+	case errors.Is(err, fus.ErrServerBusy):
+		return exitServerBusy, "The server is busy; try again later."
+	case errors.Is(err, download.ErrIntegrity):
+		return exitIntegrity, "The download is corrupt and was not decrypted; delete its .part file and download again."
+	case errors.Is(err, download.ErrNoSpace):
+		return exitNoSpace, "Free up space or choose another output directory; -no-space-check skips this check."
+	case errors.Is(err, firmware.ErrWrongKey), errors.Is(err, firmware.ErrBadPadding):
+		return exitWrongKey, "Check the firmware version (-v), model (-m) and region (-r), and the encryption version (-V) if given."
+	case errors.Is(err, firmware.ErrNoKeyInfo):
+		return exitWrongKey, "The server's BinaryInform reply lacks the values the decryption key is derived from."
+	case errors.As(err, &netErr), errors.As(err, &urlErr):
+		return exitNetwork, ""
+	}
+	return exitError, ""
+}
@@ -0,0 +1,140 @@
+// Package firmware derives firmware decryption keys and decrypts the AES-ECB
+// encrypted .enc2/.enc4 images served by FUS.
+package firmware
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/md5"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/mattchengg/susgo/fota"
+	"github.com/mattchengg/susgo/fus"
+)
+
+// ErrNoKeyInfo is returned for a BinaryInform reply that lacks the
+// LATEST_FW_VERSION or LOGIC_VALUE_FACTORY values the .enc4 key derives from.
+var ErrNoKeyInfo = errors.New("no LATEST_FW_VERSION or LOGIC_VALUE_FACTORY to derive the V4 key from")
+
+// V4Key derives the .enc4 key from the LATEST_FW_VERSION and
+// LOGIC_VALUE_FACTORY values returned by BinaryInform.
+func V4Key(fwVersion, logicValue string) ([]byte, error) {
+	decKey := fus.LogicCheck(fwVersion, logicValue)
+	if decKey == "" {
+		return nil, ErrNoKeyInfo
+	}
+	hash := md5.Sum([]byte(decKey))
+	return hash[:], nil
+}
+
+// FetchV4Key queries the server for version and derives its .enc4 key.
+func FetchV4Key(ctx context.Context, c *fus.Client, version, model, region, imei string) ([]byte, error) {
+	info, err := c.BinaryInform(ctx, fota.NormalizeVersion(version), model, region, imei)
+	if err != nil {
+		return nil, err
+	}
+	return V4Key(info.LatestFWVersion, info.LogicValueFactory)
+}
+
+// V2Key derives the .enc2 key, which depends only on the firmware identity.
+func V2Key(version, model, region string) []byte {
+	decKey := region + ":" + model + ":" + version
+	hash := md5.Sum([]byte(decKey))
+	return hash[:]
+}
+
+// DecryptFile decrypts inFile into outFile with key, with workers
+// goroutines decrypting regions of it concurrently as in DecryptAt. If
+// progress is non-nil it is called with the number of bytes processed so
+// far. The output is written to outFile.part and renamed to outFile on
+// success, so outFile never holds a partial result; on failure or
+// cancellation the temporary file is removed.
+func DecryptFile(ctx context.Context, inFile, outFile string, key []byte, workers int, progress func(done, total int64)) error {
+	inf, err := os.Open(inFile)
+	if err != nil {
+		return err
+	}
+	defer inf.Close()
+
+	stat, err := inf.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size()%aes.BlockSize != 0 {
+		return errBlockSize
+	}
+	return CreateAtomic(outFile, func(outf *os.File) error {
+		_, err := DecryptAt(ctx, outf, inf, stat.Size(), key, workers, progress)
+		return err
+	})
+}
+
+// DecryptToFile decrypts src, of size bytes or -1 if unknown, into outFile
+// like DecryptFile, but sequentially, for input that cannot be read at
+// random offsets.
+func DecryptToFile(ctx context.Context, outFile string, src io.Reader, size int64, key []byte, progress func(done, total int64)) error {
+	if size%aes.BlockSize != 0 && size >= 0 {
+		return errBlockSize
+	}
+	return CreateAtomic(outFile, func(outf *os.File) error {
+		return Decrypt(ctx, outf, src, key, size, progress)
+	})
+}
+
+// CreateAtomic calls write with outFile.part and renames it to outFile if
+// write succeeds, removing it otherwise.
+func CreateAtomic(outFile string, write func(*os.File) error) (err error) {
+	tmpFile := outFile + ".part"
+	outf, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := outf.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmpFile, outFile)
+		}
+		if err != nil {
+			os.Remove(tmpFile)
+		}
+	}()
+	return write(outf)
+}
+
+// Decrypt decrypts src into dst with key through a Reader, stripping the
+// padding at the end of src. size is the length of src, or -1 if unknown,
+// and is passed to progress as the total.
+func Decrypt(ctx context.Context, dst io.Writer, src io.Reader, key []byte, size int64, progress func(done, total int64)) error {
+	r, err := NewDecryptReader(&progressReader{ctx: ctx, r: src, size: size, progress: progress}, key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+// progressReader reports the ciphertext read through it and stops reading
+// once ctx is cancelled.
+type progressReader struct {
+	ctx      context.Context
+	r        io.Reader
+	size     int64
+	done     int64
+	progress func(done, total int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	r.done += int64(n)
+	if n > 0 && r.progress != nil {
+		r.progress(r.done, r.size)
+	}
+	return n, err
+}
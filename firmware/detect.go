@@ -0,0 +1,67 @@
+package firmware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"errors"
+	"strings"
+)
+
+// ErrWrongKey is returned when the first block of firmware does not decrypt
+// to the start of a zip, which means the key or encryption version is wrong.
+var ErrWrongKey = errors.New("firmware does not decrypt to a zip, wrong key or encryption version")
+
+// zipHeader is the signature of a zip local file header, with which every
+// firmware zip starts.
+var zipHeader = []byte("PK\x03\x04")
+
+// CheckKey reports whether key decrypts first, the first block of encrypted
+// firmware, to the start of a zip.
+func CheckKey(first, key []byte) bool {
+	c, err := NewCipher(key)
+	if err != nil || len(first) < aes.BlockSize {
+		return false
+	}
+	buf := bytes.Clone(first[:aes.BlockSize])
+	c.Decrypt(buf)
+	return bytes.HasPrefix(buf, zipHeader)
+}
+
+// FileVersion returns the encryption version of an encrypted firmware file
+// from its .enc2 or .enc4 suffix, or 0 if it has neither.
+func FileVersion(name string) int {
+	switch {
+	case strings.HasSuffix(name, ".enc2"):
+		return 2
+	case strings.HasSuffix(name, ".enc4"):
+		return 4
+	}
+	return 0
+}
+
+// Versions returns the encryption versions to try for the file name, the
+// one its suffix names first.
+func Versions(name string) []int {
+	if FileVersion(name) == 4 {
+		return []int{4, 2}
+	}
+	return []int{2, 4}
+}
+
+// SelectKey returns the first of versions whose key, as returned by key,
+// decrypts first to the start of a zip, and that key. Keys are only derived
+// until one fits, so a V4 key that needs a BinaryInform request is not
+// fetched for V2 firmware tried first. If none fits, the error is
+// ErrWrongKey.
+func SelectKey(first []byte, versions []int, key func(version int) ([]byte, error)) (int, []byte, error) {
+	for _, v := range versions {
+		k, err := key(v)
+		if err != nil {
+			return 0, nil, err
+		}
+		if CheckKey(first, k) {
+			return v, k, nil
+		}
+	}
+	return 0, nil, ErrWrongKey
+}
@@ -0,0 +1,77 @@
+package firmware
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestCheckKey(t *testing.T) {
+	first := encrypt(t, []byte("PK\x03\x04 the rest of the zip"))
+	other := V2Key("S928BXXU1AXA1/S928BOXM1AXA1/S928BXXU1AXA1/S928BXXU1AXA1", "SM-S928B", "XAR")
+	tests := []struct {
+		name  string
+		first []byte
+		key   []byte
+		want  bool
+	}{
+		{"right key", first, testKey, true},
+		{"wrong key", first, other, false},
+		{"not a zip", encrypt(t, []byte("not a zip at all")), testKey, false},
+		{"short block", first[:15], testKey, false},
+		{"invalid key", first, testKey[:5], false},
+	}
+	for _, tt := range tests {
+		if got := CheckKey(tt.first, tt.key); got != tt.want {
+			t.Errorf("%s: CheckKey = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSelectKey(t *testing.T) {
+	v2 := testKey
+	v4 := V2Key("S928BXXU1AXA1/S928BOXM1AXA1/S928BXXU1AXA1/S928BXXU1AXA1", "SM-S928B", "XAR")
+	keys := map[int][]byte{2: v2, 4: v4}
+	errFetch := errors.New("BinaryInform failed")
+
+	tests := []struct {
+		name     string
+		key      []byte // the firmware is encrypted with
+		versions []int
+		fail     int // version whose key cannot be derived
+		want     int
+		tried    []int
+		err      error
+	}{
+		{"enc4 tried first", v4, Versions("fw.zip.enc4"), 0, 4, []int{4}, nil},
+		{"enc2 tried first", v2, Versions("fw.zip.enc2"), 0, 2, []int{2}, nil},
+		{"enc2 named enc4", v2, Versions("fw.zip.enc4"), 0, 2, []int{4, 2}, nil},
+		{"enc4 without suffix", v4, Versions("fw.zip"), 0, 4, []int{2, 4}, nil},
+		{"enc4 not fetched for enc2", v2, Versions("fw.zip.enc2"), 4, 2, []int{2}, nil},
+		{"wrong version forced", v4, []int{2}, 0, 0, []int{2}, ErrWrongKey},
+		{"key error", v4, []int{2, 4}, 4, 0, []int{2, 4}, errFetch},
+	}
+	for _, tt := range tests {
+		c, err := NewCipher(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		enc := Pad([]byte("PK\x03\x04"))
+		c.Encrypt(enc)
+		var tried []int
+		v, key, err := SelectKey(enc, tt.versions, func(v int) ([]byte, error) {
+			tried = append(tried, v)
+			if v == tt.fail {
+				return nil, errFetch
+			}
+			return keys[v], nil
+		})
+		if v != tt.want || !errors.Is(err, tt.err) || !slices.Equal(tried, tt.tried) {
+			t.Errorf("%s: SelectKey = %d, %v after trying %v; want %d, %v after %v", tt.name, v, err, tried, tt.want, tt.err, tt.tried)
+		}
+		if err == nil && !bytes.Equal(key, tt.key) {
+			t.Errorf("%s: SelectKey returned the key of another version", tt.name)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package firmware
+
+import (
+	"context"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// regionSize is the amount of ciphertext a DecryptAt worker reads, decrypts
+// and writes at a time.
+const regionSize = 4 << 20
+
+// DecryptAt decrypts the size bytes of src into dst with key. Through a
+// ReaderAt, workers goroutines decrypt regions of the file concurrently;
+// zero or less means one per CPU. The padding is stripped, so dst receives
+// the returned number of bytes. progress, if non-nil, is called with the
+// bytes decrypted so far, by one goroutine at a time.
+func DecryptAt(ctx context.Context, dst io.WriterAt, src io.ReaderAt, size int64, key []byte, workers int, progress func(done, total int64)) (int64, error) {
+	ra, err := NewDecryptReaderAt(src, size, key)
+	if err != nil {
+		return 0, err
+	}
+	plain := ra.Size()
+	if plain == 0 {
+		return 0, nil
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	regions := make(chan int64)
+	go func() {
+		defer close(regions)
+		for off := int64(0); off < plain; off += regionSize {
+			select {
+			case regions <- off:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var done int64
+	var wg sync.WaitGroup
+	for range min(int64(workers), (plain+regionSize-1)/regionSize) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, regionSize)
+			for off := range regions {
+				n, err := ra.ReadAt(buf, off)
+				if err == io.EOF && off+int64(n) == plain {
+					err = nil
+				}
+				if err == nil {
+					_, err = dst.WriteAt(buf[:n], off)
+				}
+				if err != nil {
+					cancel(err)
+					return
+				}
+				if progress != nil {
+					// The padding counts towards the last region.
+					end := off + int64(n)
+					if end == plain {
+						end = size
+					}
+					mu.Lock()
+					done += end - off
+					progress(done, size)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := context.Cause(ctx); err != nil && err != context.Canceled {
+		return 0, err
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return plain, nil
+}
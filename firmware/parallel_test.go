@@ -0,0 +1,57 @@
+package firmware
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// bufferAt is an io.WriterAt into a preallocated buffer. Concurrent writes
+// to distinct regions are safe.
+type bufferAt []byte
+
+func (b bufferAt) WriteAt(p []byte, off int64) (int, error) {
+	return copy(b[off:], p), nil
+}
+
+func TestDecryptAt(t *testing.T) {
+	for _, n := range []int{0, 16, regionSize - 16, regionSize + 16, 9<<20 + 3} {
+		enc := encrypt(t, plaintext(n))
+		size := int64(len(enc))
+		var want bytes.Buffer
+		if err := Decrypt(context.Background(), &want, bytes.NewReader(enc), testKey, size, nil); err != nil {
+			t.Fatalf("%d bytes: Decrypt: %v", n, err)
+		}
+		for _, workers := range []int{1, 3, 8} {
+			got := make(bufferAt, n)
+			var done int64
+			progress := func(d, total int64) {
+				if d < done || total != size {
+					t.Errorf("%d bytes, %d workers: progress(%d, %d) after %d", n, workers, d, total, done)
+				}
+				done = d
+			}
+			plain, err := DecryptAt(context.Background(), got, bytes.NewReader(enc), size, testKey, workers, progress)
+			if err != nil || plain != int64(n) {
+				t.Errorf("%d bytes, %d workers: DecryptAt = %d, %v", n, workers, plain, err)
+				continue
+			}
+			if !bytes.Equal(got, want.Bytes()) {
+				t.Errorf("%d bytes, %d workers: output differs from Decrypt", n, workers)
+			}
+			if n > 0 && done != size {
+				t.Errorf("%d bytes, %d workers: progress ended at %d, want %d", n, workers, done, size)
+			}
+		}
+	}
+}
+
+func TestDecryptAtCancel(t *testing.T) {
+	enc := encrypt(t, plaintext(9<<20+3))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	got := make(bufferAt, len(enc))
+	if _, err := DecryptAt(ctx, got, bytes.NewReader(enc), int64(len(enc)), testKey, 3, nil); err != context.Canceled {
+		t.Errorf("DecryptAt = %v, want %v", err, context.Canceled)
+	}
+}
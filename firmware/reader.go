@@ -0,0 +1,233 @@
+package firmware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"io"
+)
+
+// ErrBadPadding is returned when decrypted firmware does not end in valid
+// PKCS#7 padding, which means the key is wrong.
+var ErrBadPadding = errors.New("invalid padding after decryption, wrong key?")
+
+// errBlockSize is returned for input that is not a whole number of blocks.
+var errBlockSize = errors.New("invalid input block size")
+
+// readerBuffer is the amount of ciphertext a Reader reads at a time.
+const readerBuffer = 32 << 10
+
+// Reader decrypts firmware read from an io.Reader.
+type Reader struct {
+	r     io.Reader
+	c     *Cipher
+	buf   []byte
+	start int // buf[start:n] is ciphertext not yet decrypted
+	n     int
+	out   []byte // plaintext not yet returned
+	err   error  // returned once out is drained
+}
+
+// NewDecryptReader returns a Reader of the plaintext of the firmware read
+// from r, decrypted with key. The last block is held back until the end of
+// r, where its PKCS#7 padding is stripped; input that does not end on a
+// block boundary, or in valid padding, fails there. Empty input gives empty
+// output.
+func NewDecryptReader(r io.Reader, key []byte) (*Reader, error) {
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, c: c, buf: make([]byte, readerBuffer+aes.BlockSize)}, nil
+}
+
+func (d *Reader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.fill()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// fill reads more ciphertext and decrypts all whole blocks of it but the
+// last, which might carry the padding.
+func (d *Reader) fill() {
+	d.n = copy(d.buf, d.buf[d.start:d.n])
+	d.start = 0
+	m, err := d.r.Read(d.buf[d.n:])
+	d.n += m
+	switch {
+	case err == io.EOF:
+		d.err = io.EOF
+		if d.n == 0 {
+			return
+		}
+		if d.n%aes.BlockSize != 0 {
+			d.err = errBlockSize
+			return
+		}
+		d.c.Decrypt(d.buf[:d.n])
+		pad, perr := PaddingLen(d.buf[d.n-aes.BlockSize : d.n])
+		if perr != nil {
+			d.err = perr
+			return
+		}
+		d.out, d.start = d.buf[:d.n-pad], d.n
+	case err != nil:
+		d.err = err
+	default:
+		whole := d.n&^(aes.BlockSize-1) - aes.BlockSize
+		if whole > 0 {
+			d.c.Decrypt(d.buf[:whole])
+			d.out, d.start = d.buf[:whole], whole
+		}
+	}
+}
+
+// ReaderAt decrypts firmware at any offset of an io.ReaderAt; see Cipher. An
+// encrypted firmware zip can be opened with zip.NewReader(ra, ra.Size()). It
+// is safe for concurrent use if r is.
+type ReaderAt struct {
+	r    io.ReaderAt
+	c    *Cipher
+	size int64
+}
+
+// NewDecryptReaderAt returns a ReaderAt of the plaintext of the size bytes
+// of firmware in r, decrypted with key. The last block is read to find the
+// size of the plaintext, so a wrong key is reported as ErrBadPadding.
+func NewDecryptReaderAt(r io.ReaderAt, size int64, key []byte) (*ReaderAt, error) {
+	if size < 0 || size%aes.BlockSize != 0 {
+		return nil, errBlockSize
+	}
+	c, err := NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ra := &ReaderAt{r: r, c: c}
+	if size > 0 {
+		last := make([]byte, aes.BlockSize)
+		if err := ra.readBlocks(last, size-aes.BlockSize); err != nil {
+			return nil, err
+		}
+		pad, err := PaddingLen(last)
+		if err != nil {
+			return nil, err
+		}
+		ra.size = size - int64(pad)
+	}
+	return ra, nil
+}
+
+// Size returns the size of the plaintext.
+func (ra *ReaderAt) Size() int64 {
+	return ra.size
+}
+
+// ReadAt reads the plaintext at off. Whole blocks are decrypted in place in
+// p; a block only partly requested goes through a small buffer.
+func (ra *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("firmware: negative offset")
+	}
+	if off >= ra.size {
+		return 0, io.EOF
+	}
+	want := int(min(int64(len(p)), ra.size-off))
+	n := 0
+	for n < want {
+		pos := off + int64(n)
+		if pos%aes.BlockSize != 0 || want-n < aes.BlockSize {
+			var blk [aes.BlockSize]byte
+			start := pos &^ (aes.BlockSize - 1)
+			if err := ra.readBlocks(blk[:], start); err != nil {
+				return n, err
+			}
+			n += copy(p[n:want], blk[pos-start:])
+			continue
+		}
+		m := (want - n) &^ (aes.BlockSize - 1)
+		if err := ra.readBlocks(p[n:n+m], pos); err != nil {
+			return n, err
+		}
+		n += m
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readBlocks reads and decrypts the whole blocks at off into buf.
+func (ra *ReaderAt) readBlocks(buf []byte, off int64) error {
+	n, err := ra.r.ReadAt(buf, off)
+	if n < len(buf) {
+		if err == io.EOF || err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	ra.c.Decrypt(buf)
+	return nil
+}
+
+// Cipher is the AES-ECB cipher of firmware files. AES-ECB encrypts every
+// 16-byte block on its own, so any whole blocks of a file, at any offset and
+// in any order, can be decrypted or encrypted separately. Ranged and
+// resumed downloads, random access and parallel decryption all rely on it.
+type Cipher struct {
+	block cipher.Block
+}
+
+// NewCipher returns the Cipher of key.
+func NewCipher(key []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{block: block}, nil
+}
+
+// Decrypt decrypts the whole blocks of p in place.
+func (c *Cipher) Decrypt(p []byte) {
+	for i := 0; i+aes.BlockSize <= len(p); i += aes.BlockSize {
+		c.block.Decrypt(p[i:i+aes.BlockSize], p[i:i+aes.BlockSize])
+	}
+}
+
+// Encrypt encrypts the whole blocks of p in place.
+func (c *Cipher) Encrypt(p []byte) {
+	for i := 0; i+aes.BlockSize <= len(p); i += aes.BlockSize {
+		c.block.Encrypt(p[i:i+aes.BlockSize], p[i:i+aes.BlockSize])
+	}
+}
+
+// Pad returns a copy of p with the PKCS#7 padding that PaddingLen finds
+// appended, a whole number of blocks to encrypt.
+func Pad(p []byte) []byte {
+	pad := aes.BlockSize - len(p)%aes.BlockSize
+	return append(bytes.Clone(p), bytes.Repeat([]byte{byte(pad)}, pad)...)
+}
+
+// PaddingLen returns the length of the PKCS#7 padding that ends last, the
+// decrypted final block of a file, or ErrBadPadding if there is none.
+func PaddingLen(last []byte) (int, error) {
+	if len(last) != aes.BlockSize {
+		return 0, ErrBadPadding
+	}
+	pad := int(last[aes.BlockSize-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return 0, ErrBadPadding
+	}
+	for _, b := range last[aes.BlockSize-pad:] {
+		if int(b) != pad {
+			return 0, ErrBadPadding
+		}
+	}
+	return pad, nil
+}
@@ -0,0 +1,135 @@
+package firmware
+
+import (
+	"bytes"
+	"crypto/aes"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+var testKey = V2Key("S928BXXU1AXA1/S928BOXM1AXA1/S928BXXU1AXA1/S928BXXU1AXA1", "SM-S928B", "EUX")
+
+// encrypt pads plain with PKCS#7 and encrypts it with testKey.
+func encrypt(t *testing.T, plain []byte) []byte {
+	t.Helper()
+	return encryptRaw(t, Pad(plain))
+}
+
+// encryptRaw encrypts the whole blocks of p with testKey, without padding.
+func encryptRaw(t *testing.T, p []byte) []byte {
+	t.Helper()
+	c, err := NewCipher(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = bytes.Clone(p)
+	c.Encrypt(p)
+	return p
+}
+
+func plaintext(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i * 7)
+	}
+	return p
+}
+
+func TestReader(t *testing.T) {
+	for _, n := range []int{0, 1, 15, 16, 17, 100, readerBuffer - 1, readerBuffer, readerBuffer + 16} {
+		plain := plaintext(n)
+		r, err := NewDecryptReader(iotest.HalfReader(bytes.NewReader(encrypt(t, plain))), testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: ReadAll = %d bytes, %v", n, len(got), err)
+		}
+	}
+}
+
+func TestReaderAtLastBlock(t *testing.T) {
+	for _, n := range []int{0, 1, 15, 16, 17, 31, 32, 100} {
+		plain := plaintext(n)
+		enc := encrypt(t, plain)
+		ra, err := NewDecryptReaderAt(bytes.NewReader(enc), int64(len(enc)), testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ra.Size() != int64(n) {
+			t.Errorf("%d bytes: Size() = %d", n, ra.Size())
+		}
+		// Every read around the final block, including ones that run
+		// past the end of the plaintext.
+		for off := max(0, n-2*aes.BlockSize); off <= n; off++ {
+			for l := 0; l <= 2*aes.BlockSize+1; l++ {
+				p := make([]byte, l)
+				got, err := ra.ReadAt(p, int64(off))
+				want := min(l, n-off)
+				if got != want || !bytes.Equal(p[:got], plain[off:off+want]) {
+					t.Fatalf("%d bytes: ReadAt(%d bytes, %d) = %d, %v; want %d", n, l, off, got, err, want)
+				}
+				var wantErr error
+				if want < l || off == n {
+					wantErr = io.EOF
+				}
+				if err != wantErr {
+					t.Fatalf("%d bytes: ReadAt(%d bytes, %d) error = %v, want %v", n, l, off, err, wantErr)
+				}
+			}
+		}
+	}
+}
+
+func TestBadPadding(t *testing.T) {
+	good := plaintext(aes.BlockSize)
+	tests := []struct {
+		name string
+		last []byte
+	}{
+		{"zero", append(good[:15:15], 0)},
+		{"too long", append(good[:15:15], aes.BlockSize+1)},
+		{"mismatched", append(good[:13:13], 2, 3, 3)},
+		{"all mismatched", append(bytes.Repeat([]byte{16}, 15), 15)},
+	}
+	for _, tt := range tests {
+		if _, err := PaddingLen(tt.last); err != ErrBadPadding {
+			t.Errorf("%s: PaddingLen = %v, want %v", tt.name, err, ErrBadPadding)
+		}
+		enc := encryptRaw(t, append(bytes.Clone(good), tt.last...))
+		if _, err := NewDecryptReaderAt(bytes.NewReader(enc), int64(len(enc)), testKey); err != ErrBadPadding {
+			t.Errorf("%s: NewDecryptReaderAt = %v, want %v", tt.name, err, ErrBadPadding)
+		}
+		r, err := NewDecryptReader(bytes.NewReader(enc), testKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != ErrBadPadding {
+			t.Errorf("%s: Reader error = %v, want %v", tt.name, err, ErrBadPadding)
+		}
+		if len(got) > len(good) {
+			t.Errorf("%s: Reader returned %d bytes of the bad block", tt.name, len(got)-len(good))
+		}
+	}
+	if _, err := PaddingLen(bytes.Repeat([]byte{1}, aes.BlockSize-1)); err != ErrBadPadding {
+		t.Errorf("PaddingLen of a short block = %v, want %v", err, ErrBadPadding)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	enc := encrypt(t, plaintext(40))
+	enc = enc[:len(enc)-1]
+	if _, err := NewDecryptReaderAt(bytes.NewReader(enc), int64(len(enc)), testKey); err != errBlockSize {
+		t.Errorf("NewDecryptReaderAt = %v, want %v", err, errBlockSize)
+	}
+	r, err := NewDecryptReader(bytes.NewReader(enc), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != errBlockSize {
+		t.Errorf("Reader error = %v, want %v", err, errBlockSize)
+	}
+}
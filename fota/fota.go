@@ -0,0 +1,195 @@
+// Package fota reads the public FOTA version.xml listing that announces the
+// latest and upgradeable firmware versions for a model and region.
+package fota
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattchengg/susgo/transport"
+)
+
+// FirmwareSpec is a firmware version and, when known, its size in bytes.
+type FirmwareSpec struct {
+	Version string
+	Size    int64
+}
+
+// VersionInfo lists the firmware versions published for a model and region.
+type VersionInfo struct {
+	Latest  FirmwareSpec
+	Upgrade []FirmwareSpec
+}
+
+type versionXML struct {
+	XMLName  xml.Name `xml:"versioninfo"`
+	Firmware struct {
+		Version struct {
+			Latest  string `xml:"latest"`
+			Upgrade struct {
+				Value []struct {
+					Text   string `xml:",chardata"`
+					FWSize string `xml:"fwsize,attr"`
+				} `xml:"value"`
+			} `xml:"upgrade"`
+		} `xml:"version"`
+	} `xml:"firmware"`
+}
+
+// Errors returned when version.xml has nothing for the model and region.
+var (
+	ErrNotFound   = errors.New("model or region not found")
+	ErrNoFirmware = errors.New("no firmware available")
+)
+
+// DefaultBaseURL is the FOTA server hosting version.xml.
+const DefaultBaseURL = "https://fota-cloud-dn.ospserver.net"
+
+// Client fetches version.xml from a FOTA server.
+type Client struct {
+	client  *http.Client
+	baseURL string
+	log     *slog.Logger
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithBaseURL fetches version.xml from url instead of DefaultBaseURL.
+func WithBaseURL(url string) Option {
+	return func(c *Client) { c.baseURL = strings.TrimSuffix(url, "/") }
+}
+
+// WithHTTPClient makes the client send its requests through hc.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.client = hc }
+}
+
+// WithLogger records every version.xml request and response at debug level
+// on l.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Client) { c.log = l }
+}
+
+// NewClient returns a Client configured by opts.
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		client:  transport.Default(),
+		baseURL: DefaultBaseURL,
+		log:     slog.New(slog.DiscardHandler),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// DefaultClient is used by the package-level functions.
+var DefaultClient = NewClient()
+
+// NormalizeVersion expands a version code to the four-part
+// PDA/CSC/MODEM/BOOTLOADER form, filling missing parts from the PDA part.
+func NormalizeVersion(vercode string) string {
+	ver := strings.Split(vercode, "/")
+	if len(ver) == 3 {
+		ver = append(ver, ver[0])
+	}
+	if len(ver) >= 3 && ver[2] == "" {
+		ver[2] = ver[0]
+	}
+	return strings.Join(ver, "/")
+}
+
+func (c *Client) fetchVersionXML(ctx context.Context, model, region string) ([]byte, error) {
+	url := fmt.Sprintf("%s/firmware/%s/%s/version.xml", c.baseURL, region, model)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Kies2.0_FUS")
+
+	c.log.Debug("fota request", "url", url)
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.log.Debug("fota request failed", "url", url, "duration", time.Since(start), "err", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	c.log.Debug("fota response", "url", url, "status", resp.StatusCode, "duration", time.Since(start), "body", string(body))
+
+	if resp.StatusCode == 403 {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return body, err
+}
+
+// LatestVersion returns the normalized latest firmware version using
+// DefaultClient.
+func LatestVersion(ctx context.Context, model, region string) (string, error) {
+	return DefaultClient.LatestVersion(ctx, model, region)
+}
+
+// GetVersionInfo returns the latest version and every listed upgrade using
+// DefaultClient.
+func GetVersionInfo(ctx context.Context, model, region string) (*VersionInfo, error) {
+	return DefaultClient.GetVersionInfo(ctx, model, region)
+}
+
+// LatestVersion returns the normalized latest firmware version.
+func (c *Client) LatestVersion(ctx context.Context, model, region string) (string, error) {
+	body, err := c.fetchVersionXML(ctx, model, region)
+	if err != nil {
+		return "", err
+	}
+
+	var v versionXML
+	if err := xml.Unmarshal(body, &v); err != nil {
+		return "", err
+	}
+
+	if v.Firmware.Version.Latest == "" {
+		return "", ErrNoFirmware
+	}
+	return NormalizeVersion(v.Firmware.Version.Latest), nil
+}
+
+// GetVersionInfo returns the latest version and every listed upgrade.
+func (c *Client) GetVersionInfo(ctx context.Context, model, region string) (*VersionInfo, error) {
+	body, err := c.fetchVersionXML(ctx, model, region)
+	if err != nil {
+		return nil, err
+	}
+
+	var v versionXML
+	if err := xml.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+
+	info := &VersionInfo{}
+	if v.Firmware.Version.Latest != "" {
+		info.Latest = FirmwareSpec{Version: NormalizeVersion(v.Firmware.Version.Latest)}
+	}
+
+	for _, u := range v.Firmware.Version.Upgrade.Value {
+		size, _ := strconv.ParseInt(u.FWSize, 10, 64)
+		info.Upgrade = append(info.Upgrade, FirmwareSpec{
+			Version: NormalizeVersion(u.Text),
+			Size:    size,
+		})
+	}
+	return info, nil
+}
@@ -1,4 +1,4 @@
-package main
+package fus
 
 import (
 	"bytes"
@@ -8,8 +8,8 @@ import (
 )
 
 const (
-	KEY_1 = "vicopx7dqu06emacgpnpy8j8zwhduwlh"
-	KEY_2 = "9u7qab84rpc16gvk"
+	key1 = "vicopx7dqu06emacgpnpy8j8zwhduwlh"
+	key2 = "9u7qab84rpc16gvk"
 )
 
 func pkcs7Pad(data []byte, blockSize int) []byte {
@@ -58,9 +58,9 @@ func aesDecrypt(input, key []byte) ([]byte, error) {
 func deriveKey(nonce string) []byte {
 	key := make([]byte, 32)
 	for i := 0; i < 16; i++ {
-		key[i] = KEY_1[int(nonce[i])%16]
+		key[i] = key1[int(nonce[i])%16]
 	}
-	copy(key[16:], KEY_2)
+	copy(key[16:], key2)
 	return key
 }
 
@@ -78,9 +78,25 @@ func decryptNonce(encNonce string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	decrypted, err := aesDecrypt(data, []byte(KEY_1))
+	decrypted, err := aesDecrypt(data, []byte(key1))
 	if err != nil {
 		return "", err
 	}
 	return string(decrypted), nil
 }
+
+// Signature returns the signature a client sends in the Authorization header
+// for nonce.
+func Signature(nonce string) (string, error) {
+	return getAuth(nonce)
+}
+
+// EncryptNonce encodes nonce the way the server sends it in the NONCE
+// response header. It is only needed to implement a server.
+func EncryptNonce(nonce string) (string, error) {
+	data, err := aesEncrypt([]byte(nonce), []byte(key1))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,375 @@
+// Package fus implements a client for Samsung's Firmware Update Server (FUS),
+// which hands out firmware metadata and serves the encrypted firmware images.
+package fus
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattchengg/susgo/transport"
+)
+
+// Default service endpoints.
+const (
+	DefaultBaseURL     = "https://neofussvr.sslcs.cdngc.net"
+	DefaultDownloadURL = "http://cloud-neofussvr.samsungmobile.com"
+)
+
+// Client holds the session state negotiated with the FUS server. Its methods
+// are safe for concurrent use; the exported session fields must not be
+// modified while requests are in flight.
+type Client struct {
+	Auth        string
+	SessID      string
+	EncNonce    string
+	Nonce       string
+	client      *http.Client
+	baseURL     string
+	downloadURL string
+	retry       RetryPolicy
+	log         *slog.Logger
+	unredacted  bool
+
+	// mu guards the session fields; epoch counts negotiated nonces so that
+	// concurrent requests rejected by the same stale session renew it once.
+	mu      sync.Mutex
+	epoch   int
+	renewMu sync.Mutex
+
+	// Session steps replayed by Renew.
+	inform   *informArgs
+	initFile string
+}
+
+type informArgs struct {
+	fw, model, region, imei string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithBaseURL points the nonce, BinaryInform and BinaryInit requests at url
+// instead of DefaultBaseURL.
+func WithBaseURL(url string) Option {
+	return func(c *Client) { c.baseURL = strings.TrimSuffix(url, "/") }
+}
+
+// WithDownloadURL points firmware downloads at url instead of
+// DefaultDownloadURL.
+func WithDownloadURL(url string) Option {
+	return func(c *Client) { c.downloadURL = strings.TrimSuffix(url, "/") }
+}
+
+// WithHTTPClient makes the client send its requests through hc.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.client = hc }
+}
+
+// BinaryInfo is the firmware metadata returned by NF_DownloadBinaryInform.
+type BinaryInfo struct {
+	LatestFWVersion   string
+	LogicValueFactory string
+	BinaryName        string
+	BinaryByteSize    int64
+	BinaryCRC         uint32 // CRC-32 of the encrypted file; zero if not sent
+	ModelPath         string
+}
+
+// NewClient creates a client and requests an initial nonce from the server.
+func NewClient(ctx context.Context, opts ...Option) (*Client, error) {
+	c := &Client{
+		client:      transport.Default(),
+		baseURL:     DefaultBaseURL,
+		downloadURL: DefaultDownloadURL,
+		retry:       DefaultRetryPolicy,
+		log:         slog.New(slog.DiscardHandler),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := c.do(ctx, func() error { return c.generateNonce(ctx) }); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// generateNonce starts a fresh session with a new nonce.
+func (c *Client) generateNonce(ctx context.Context) error {
+	c.mu.Lock()
+	c.SessID, c.Auth, c.Nonce, c.EncNonce = "", "", "", ""
+	c.mu.Unlock()
+	if _, err := c.MakeReq(ctx, "NF_DownloadGenerateNonce.do", ""); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Nonce == "" {
+		return fmt.Errorf("NF_DownloadGenerateNonce.do: no nonce in response: %w", ErrAuth)
+	}
+	c.epoch++
+	return nil
+}
+
+// session returns a consistent snapshot of the session fields.
+func (c *Client) session() (auth, sessID, encNonce, nonce string, epoch int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Auth, c.SessID, c.EncNonce, c.Nonce, c.epoch
+}
+
+// Renew negotiates a new nonce and session, then replays the last successful
+// BinaryInform and BinaryInit so that downloads are authorized again.
+func (c *Client) Renew(ctx context.Context) error {
+	c.renewMu.Lock()
+	defer c.renewMu.Unlock()
+	return c.renew(ctx)
+}
+
+// renewStale renews the session unless another request already did so since
+// the session of the given epoch was rejected.
+func (c *Client) renewStale(ctx context.Context, epoch int) error {
+	c.renewMu.Lock()
+	defer c.renewMu.Unlock()
+	if _, _, _, _, current := c.session(); current != epoch {
+		return nil
+	}
+	return c.renew(ctx)
+}
+
+func (c *Client) renew(ctx context.Context) error {
+	c.log.Info("renewing fus session")
+	if err := c.generateNonce(ctx); err != nil {
+		return err
+	}
+	if a := c.inform; a != nil {
+		if _, err := c.binaryInform(ctx, a.fw, a.model, a.region, a.imei); err != nil {
+			return err
+		}
+	}
+	if c.initFile != "" {
+		return c.binaryInit(ctx, c.initFile)
+	}
+	return nil
+}
+
+// MakeReq posts data to the given FUS endpoint and returns the response body,
+// updating the session cookie and nonce from the response.
+func (c *Client) MakeReq(ctx context.Context, path, data string) (string, error) {
+	auth, sessID, _, _, _ := c.session()
+	authv := fmt.Sprintf(`FUS nonce="", signature="%s", nc="", type="", realm="", newauth="1"`, auth)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/"+path, strings.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Authorization", authv)
+	req.Header.Set("User-Agent", "Kies2.0_FUS")
+	if sessID != "" {
+		req.AddCookie(&http.Cookie{Name: "JSESSIONID", Value: sessID})
+	}
+
+	c.log.Debug("fus request", "endpoint", path, c.headers("headers", req.Header), "body", c.body(data))
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.log.Debug("fus request failed", "endpoint", path, "duration", time.Since(start), "err", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if nonce := resp.Header.Get("NONCE"); nonce != "" {
+		decrypted, err := decryptNonce(nonce)
+		if err != nil || len(decrypted) < 16 {
+			return "", fmt.Errorf("%s: bad nonce: %w", path, ErrAuth)
+		}
+		auth, err := getAuth(decrypted)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w: %v", path, ErrAuth, err)
+		}
+		c.mu.Lock()
+		c.EncNonce, c.Nonce, c.Auth = nonce, decrypted, auth
+		c.mu.Unlock()
+	}
+
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "JSESSIONID" {
+			c.mu.Lock()
+			c.SessID = cookie.Value
+			c.mu.Unlock()
+		}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	c.log.Debug("fus response", "endpoint", path, "status", resp.StatusCode, "duration", time.Since(start),
+		c.headers("headers", resp.Header), "body", c.body(string(body)))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode >= 400 {
+		return "", &StatusError{Endpoint: path, Status: resp.StatusCode, HTTP: true}
+	}
+
+	return string(body), nil
+}
+
+// call posts a FUSMsg to path and decodes the reply, turning a non-200
+// <Status> into a *StatusError.
+func (c *Client) call(ctx context.Context, path, data string) (*FUSMsgResponse, error) {
+	resp, err := c.MakeReq(ctx, path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	var fusResp FUSMsgResponse
+	if err := xml.Unmarshal([]byte(resp), &fusResp); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	if status := fusResp.Body.Results.Status; status != 200 {
+		return nil, &StatusError{Endpoint: path, Status: status}
+	}
+	return &fusResp, nil
+}
+
+// BinaryInform asks the server for the download metadata of firmware version
+// fw. Rejections are reported as a *StatusError; a reply without a binary
+// name is reported as ErrNotFound.
+func (c *Client) BinaryInform(ctx context.Context, fw, model, region, imei string) (*BinaryInfo, error) {
+	var info *BinaryInfo
+	err := c.do(ctx, func() (err error) {
+		info, err = c.binaryInform(ctx, fw, model, region, imei)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.renewMu.Lock()
+	c.inform = &informArgs{fw, model, region, imei}
+	c.renewMu.Unlock()
+	return info, nil
+}
+
+func (c *Client) binaryInform(ctx context.Context, fw, model, region, imei string) (*BinaryInfo, error) {
+	_, _, _, nonce, _ := c.session()
+	req := binaryInformMsg(fw, model, region, imei, nonce)
+	fusResp, err := c.call(ctx, "NF_DownloadBinaryInform.do", req)
+	if err != nil {
+		return nil, err
+	}
+
+	if fusResp.Body.Put.BinaryName.Data == "" {
+		return nil, fmt.Errorf("NF_DownloadBinaryInform.do: %w", ErrNotFound)
+	}
+
+	return &BinaryInfo{
+		LatestFWVersion:   fusResp.Body.Results.LatestFWVersion.Data,
+		LogicValueFactory: fusResp.Body.Put.LogicValueFactory.Data,
+		BinaryName:        fusResp.Body.Put.BinaryName.Data,
+		BinaryByteSize:    fusResp.Body.Put.BinaryByteSize.Data,
+		BinaryCRC:         parseCRC(fusResp.Body.Put.BinaryCRC.Data),
+		ModelPath:         fusResp.Body.Put.ModelPath.Data,
+	}, nil
+}
+
+func parseCRC(s string) uint32 {
+	crc, _ := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+	return uint32(crc)
+}
+
+// BinaryInit authorizes the download of filename for the current session.
+func (c *Client) BinaryInit(ctx context.Context, filename string) error {
+	err := c.do(ctx, func() error { return c.binaryInit(ctx, filename) })
+	if err != nil {
+		return err
+	}
+	c.renewMu.Lock()
+	c.initFile = filename
+	c.renewMu.Unlock()
+	return nil
+}
+
+func (c *Client) binaryInit(ctx context.Context, filename string) error {
+	_, _, _, nonce, _ := c.session()
+	req := binaryInitMsg(filename, nonce)
+	_, err := c.call(ctx, "NF_DownloadBinaryInitForMass.do", req)
+	var se *StatusError
+	if errors.As(err, &se) && se.Status == 0 && !se.HTTP {
+		// Some servers answer the init without a <Status> element.
+		return nil
+	}
+	return err
+}
+
+// DownloadFile starts downloading filename (MODEL_PATH + BINARY_NAME),
+// resuming at byte offset start when it is non-zero. The caller must close
+// the response body; cancelling ctx aborts reads from it. Failed attempts are
+// retried, renewing the session if the server rejects the authorization.
+func (c *Client) DownloadFile(ctx context.Context, filename string, start int64) (*http.Response, error) {
+	return c.DownloadRange(ctx, filename, start, -1)
+}
+
+// DownloadRange is like DownloadFile but stops after byte offset end
+// (inclusive); a negative end reads to the end of the file. A server that
+// ignores the range is reported as an error.
+func (c *Client) DownloadRange(ctx context.Context, filename string, start, end int64) (*http.Response, error) {
+	var resp *http.Response
+	err := c.do(ctx, func() (err error) {
+		resp, err = c.downloadFile(ctx, filename, start, end)
+		return err
+	})
+	return resp, err
+}
+
+func (c *Client) downloadFile(ctx context.Context, filename string, start, end int64) (*http.Response, error) {
+	auth, _, encNonce, _, _ := c.session()
+	authv := fmt.Sprintf(`FUS nonce="%s", signature="%s", nc="", type="", realm="", newauth="1"`, encNonce, auth)
+
+	url := c.downloadURL + "/NF_DownloadBinaryForMass.do?file=" + filename
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", authv)
+	req.Header.Set("User-Agent", "Kies2.0_FUS")
+	switch {
+	case end >= 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	case start > 0:
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	}
+
+	c.log.Debug("fus request", "endpoint", "NF_DownloadBinaryForMass.do", "file", filename, "start", start,
+		c.headers("headers", req.Header))
+	t0 := time.Now()
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.log.Debug("fus request failed", "endpoint", "NF_DownloadBinaryForMass.do", "duration", time.Since(t0), "err", err)
+		return nil, err
+	}
+	c.log.Debug("fus response", "endpoint", "NF_DownloadBinaryForMass.do", "status", resp.StatusCode,
+		"duration", time.Since(t0), "length", resp.ContentLength, c.headers("headers", resp.Header))
+
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, &StatusError{Endpoint: "NF_DownloadBinaryForMass.do", Status: resp.StatusCode, HTTP: true}
+	}
+	if (start > 0 || end >= 0) && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("NF_DownloadBinaryForMass.do: server ignored range request (HTTP %d)", resp.StatusCode)
+	}
+
+	return resp, nil
+}
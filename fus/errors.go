@@ -0,0 +1,63 @@
+package fus
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors for the FUS status codes seen in practice. A *StatusError
+// unwraps to one of these, so callers can test with errors.Is.
+var (
+	ErrBadIMEI      = errors.New("IMEI or serial rejected")
+	ErrUnknownModel = errors.New("unknown model or region")
+	ErrNotFound     = errors.New("firmware not found")
+	ErrAuth         = errors.New("authorization or nonce failure")
+	ErrServerBusy   = errors.New("server busy")
+)
+
+// StatusError reports a non-success status from a FUS endpoint, either the
+// <Status> element of a FUSMsg reply or, when HTTP is set, the HTTP status.
+type StatusError struct {
+	Endpoint string
+	Status   int
+	HTTP     bool
+}
+
+func (e *StatusError) Error() string {
+	kind := "status"
+	if e.HTTP {
+		kind = "HTTP status"
+	}
+	if err := e.Unwrap(); err != nil {
+		return fmt.Sprintf("%s: %s %d (%v)", e.Endpoint, kind, e.Status, err)
+	}
+	return fmt.Sprintf("%s: %s %d", e.Endpoint, kind, e.Status)
+}
+
+// Unwrap maps the status code to its sentinel error, or nil if unknown.
+// HTTP statuses, such as those of the download server, only map to ErrAuth
+// and ErrServerBusy; their other codes do not mean what the FUS codes do.
+func (e *StatusError) Unwrap() error {
+	if e.HTTP {
+		switch {
+		case e.Status == 401, e.Status == 403:
+			return ErrAuth
+		case e.Status == 429, e.Status >= 500:
+			return ErrServerBusy
+		}
+		return nil
+	}
+	switch e.Status {
+	case 408:
+		return ErrBadIMEI
+	case 400:
+		return ErrUnknownModel
+	case 404:
+		return ErrNotFound
+	case 401, 403:
+		return ErrAuth
+	case 429, 500, 502, 503, 504:
+		return ErrServerBusy
+	}
+	return nil
+}
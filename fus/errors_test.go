@@ -0,0 +1,39 @@
+package fus
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestStatusErrorUnwrap(t *testing.T) {
+	tests := []struct {
+		status int
+		http   bool
+		want   error
+	}{
+		{408, false, ErrBadIMEI},
+		{400, false, ErrUnknownModel},
+		{404, false, ErrNotFound},
+		{401, false, ErrAuth},
+		{503, false, ErrServerBusy},
+		{200, false, nil},
+		{400, true, nil},
+		{404, true, nil},
+		{408, true, nil},
+		{416, true, nil},
+		{401, true, ErrAuth},
+		{403, true, ErrAuth},
+		{429, true, ErrServerBusy},
+		{500, true, ErrServerBusy},
+		{507, true, ErrServerBusy},
+	}
+	for _, tt := range tests {
+		err := &StatusError{Endpoint: "test", Status: tt.status, HTTP: tt.http}
+		if got := err.Unwrap(); got != tt.want {
+			t.Errorf("Status %d, HTTP %v: Unwrap() = %v, want %v", tt.status, tt.http, got, tt.want)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("Status %d, HTTP %v: errors.Is(%v) = false", tt.status, tt.http, tt.want)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package fus
+
+import (
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// WithLogger records every request and response of the FUS conversation at
+// debug level, and retries at warn level, on l. IMEIs, serials, signatures
+// and session cookies are redacted unless WithUnredactedLogs is also given.
+func WithLogger(l *slog.Logger) Option {
+	return func(c *Client) { c.log = l }
+}
+
+// WithUnredactedLogs disables redaction of logged identifiers.
+func WithUnredactedLogs() Option {
+	return func(c *Client) { c.unredacted = true }
+}
+
+var (
+	imeiElem     = regexp.MustCompile(`(<DEVICE_IMEI_PUSH>\s*<Data>)[^<]*(</Data>)`)
+	signatureArg = regexp.MustCompile(`(signature=")[^"]*(")`)
+	sessionValue = regexp.MustCompile(`(JSESSIONID=)[^;]*`)
+)
+
+// redactXML masks the IMEI or serial in a FUSMsg body.
+func redactXML(body string) string {
+	return imeiElem.ReplaceAllString(body, "${1}"+redacted+"${2}")
+}
+
+// redactHeader returns a copy of h with the Authorization signature and the
+// session cookie masked.
+func redactHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range []string{"Authorization", "Cookie", "Set-Cookie"} {
+		for i, v := range out[name] {
+			v = signatureArg.ReplaceAllString(v, "${1}"+redacted+"${2}")
+			out[name][i] = sessionValue.ReplaceAllString(v, "${1}"+redacted)
+		}
+	}
+	return out
+}
+
+func (c *Client) body(s string) string {
+	if c.unredacted {
+		return s
+	}
+	return redactXML(s)
+}
+
+func (c *Client) headers(key string, h http.Header) slog.Attr {
+	if !c.unredacted {
+		h = redactHeader(h)
+	}
+	return headerAttr(key, h)
+}
+
+// headerAttr renders h as a slog group with one attribute per header.
+func headerAttr(key string, h http.Header) slog.Attr {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attrs := make([]any, 0, len(names))
+	for _, name := range names {
+		attrs = append(attrs, slog.String(name, strings.Join(h[name], ", ")))
+	}
+	return slog.Group(key, attrs...)
+}
@@ -0,0 +1,119 @@
+package fus_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mattchengg/susgo/fus"
+	"github.com/mattchengg/susgo/fustest"
+)
+
+const (
+	testVersion = "S928BXXS4CYK8/S928BOXM4CYK8/S928BXXS4CYK8/S928BXXS4CYK8"
+	testIMEI    = "351234567871819"
+)
+
+// secretRecorder records the signatures and session IDs that pass through
+// it.
+type secretRecorder struct {
+	mu      sync.Mutex
+	secrets map[string]bool
+}
+
+var signatureRe = regexp.MustCompile(`signature="([^"]+)"`)
+
+func (r *secretRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, m := range signatureRe.FindAllStringSubmatch(req.Header.Get("Authorization"), -1) {
+		r.secrets[m[1]] = true
+	}
+	for _, c := range req.Cookies() {
+		r.secrets[c.Value] = true
+	}
+	if err == nil {
+		for _, c := range resp.Cookies() {
+			r.secrets[c.Value] = true
+		}
+	}
+	return resp, err
+}
+
+// logConversation runs a BinaryInform, BinaryInit and download request
+// against a fustest.Server, logging at debug level, and returns the log and
+// the signatures and session IDs sent.
+func logConversation(t *testing.T, opts ...fus.Option) (string, map[string]bool) {
+	t.Helper()
+	srv, err := fustest.NewServer(fustest.Firmware{Model: "SM-S928B", Region: "EUX", Version: testVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	rec := &secretRecorder{secrets: map[string]bool{}}
+	opts = append(srv.FUSOptions(), append(opts, fus.WithLogger(logger), fus.WithHTTPClient(&http.Client{Transport: rec}))...)
+
+	ctx := context.Background()
+	c, err := fus.NewClient(ctx, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.BinaryInform(ctx, testVersion, "SM-S928B", "EUX", testIMEI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BinaryInit(ctx, info.BinaryName); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.DownloadRange(ctx, info.ModelPath+info.BinaryName, 0, 15)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(rec.secrets) < 2 {
+		t.Fatalf("recorded %d signatures and session IDs, want several", len(rec.secrets))
+	}
+	return buf.String(), rec.secrets
+}
+
+func TestLogRedaction(t *testing.T) {
+	log, secrets := logConversation(t)
+	for s := range secrets {
+		if strings.Contains(log, s) {
+			t.Errorf("log contains signature or session ID %q", s)
+		}
+	}
+	if strings.Contains(log, testIMEI) {
+		t.Error("log contains the IMEI")
+	}
+	for _, want := range []string{
+		`<DEVICE_IMEI_PUSH><Data>[REDACTED]</Data>`,
+		`signature=\"[REDACTED]\"`,
+		`JSESSIONID=[REDACTED]`,
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("log lacks %s", want)
+		}
+	}
+}
+
+func TestUnredactedLogs(t *testing.T) {
+	log, secrets := logConversation(t, fus.WithUnredactedLogs())
+	if !strings.Contains(log, testIMEI) {
+		t.Error("unredacted log lacks the IMEI")
+	}
+	for s := range secrets {
+		if !strings.Contains(log, s) {
+			t.Errorf("unredacted log lacks signature or session ID %q", s)
+		}
+	}
+}
@@ -1,11 +1,12 @@
-package main
+package fus
 
 import (
 	"encoding/xml"
-	"fmt"
 )
 
-func getLogicCheck(inp, nonce string) string {
+// LogicCheck derives the LOGIC_CHECK value the FUS server expects by picking
+// characters of inp indexed by the low nibble of each nonce character.
+func LogicCheck(inp, nonce string) string {
 	if len(inp) < 16 {
 		return ""
 	}
@@ -16,29 +17,35 @@ func getLogicCheck(inp, nonce string) string {
 	return out
 }
 
+// FUSMsg is the request envelope posted to the FUS endpoints.
 type FUSMsg struct {
 	XMLName xml.Name `xml:"FUSMsg"`
 	FUSHdr  FUSHdr   `xml:"FUSHdr"`
 	FUSBody FUSBody  `xml:"FUSBody"`
 }
 
+// FUSHdr is the header of a FUSMsg.
 type FUSHdr struct {
 	ProtoVer string `xml:"ProtoVer"`
 }
 
+// FUSBody holds the Put parameters of a FUSMsg.
 type FUSBody struct {
 	Put FUSPut `xml:"Put"`
 }
 
+// FUSPut is a list of named parameters, each wrapped in a <Data> element.
 type FUSPut struct {
 	Elements []FUSElement
 }
 
+// FUSElement is a single named FUSPut parameter.
 type FUSElement struct {
 	XMLName xml.Name
 	Data    string `xml:"Data"`
 }
 
+// MarshalXML encodes every element as <NAME><Data>value</Data></NAME>.
 func (p FUSPut) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
 	e.EncodeToken(start)
 	for _, elem := range p.Elements {
@@ -51,7 +58,37 @@ func (p FUSPut) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
 	return nil
 }
 
-func binaryInform(fwv, model, region, imei, nonce string) string {
+// FUSMsgResponse is the reply returned by the FUS endpoints.
+type FUSMsgResponse struct {
+	XMLName xml.Name `xml:"FUSMsg"`
+	Body    struct {
+		Results struct {
+			LatestFWVersion struct {
+				Data string `xml:"Data"`
+			} `xml:"LATEST_FW_VERSION"`
+			Status int `xml:"Status"`
+		} `xml:"Results"`
+		Put struct {
+			LogicValueFactory struct {
+				Data string `xml:"Data"`
+			} `xml:"LOGIC_VALUE_FACTORY"`
+			BinaryName struct {
+				Data string `xml:"Data"`
+			} `xml:"BINARY_NAME"`
+			BinaryByteSize struct {
+				Data int64 `xml:"Data"`
+			} `xml:"BINARY_BYTE_SIZE"`
+			BinaryCRC struct {
+				Data string `xml:"Data"`
+			} `xml:"BINARY_CRC"`
+			ModelPath struct {
+				Data string `xml:"Data"`
+			} `xml:"MODEL_PATH"`
+		} `xml:"Put"`
+	} `xml:"FUSBody"`
+}
+
+func binaryInformMsg(fwv, model, region, imei, nonce string) string {
 	elements := []FUSElement{
 		{XMLName: xml.Name{Local: "ACCESS_MODE"}, Data: "2"},
 		{XMLName: xml.Name{Local: "BINARY_NATURE"}, Data: "1"},
@@ -64,7 +101,7 @@ func binaryInform(fwv, model, region, imei, nonce string) string {
 		{XMLName: xml.Name{Local: "DEVICE_IMEI_PUSH"}, Data: imei},
 		{XMLName: xml.Name{Local: "DEVICE_PLATFORM"}, Data: "Android"},
 		{XMLName: xml.Name{Local: "CLIENT_VERSION"}, Data: "4.3.23123_1"},
-		{XMLName: xml.Name{Local: "LOGIC_CHECK"}, Data: getLogicCheck(fwv, nonce)},
+		{XMLName: xml.Name{Local: "LOGIC_CHECK"}, Data: LogicCheck(fwv, nonce)},
 	}
 
 	if region == "EUX" {
@@ -94,7 +131,7 @@ func binaryInform(fwv, model, region, imei, nonce string) string {
 	return string(data)
 }
 
-func binaryInit(filename, nonce string) string {
+func binaryInitMsg(filename, nonce string) string {
 	checkInp := filename
 	if len(filename) > 16 {
 		base := filename
@@ -111,7 +148,7 @@ func binaryInit(filename, nonce string) string {
 
 	elements := []FUSElement{
 		{XMLName: xml.Name{Local: "BINARY_FILE_NAME"}, Data: filename},
-		{XMLName: xml.Name{Local: "LOGIC_CHECK"}, Data: getLogicCheck(checkInp, nonce)},
+		{XMLName: xml.Name{Local: "LOGIC_CHECK"}, Data: LogicCheck(checkInp, nonce)},
 	}
 
 	msg := FUSMsg{
@@ -124,21 +161,3 @@ func binaryInit(filename, nonce string) string {
 	data, _ := xml.Marshal(msg)
 	return string(data)
 }
-
-func getCheckInput(filename string) string {
-	base := filename
-	for i := len(filename) - 1; i >= 0; i-- {
-		if filename[i] == '.' {
-			base = filename[:i]
-			break
-		}
-	}
-	if len(base) < 16 {
-		return base
-	}
-	return base[len(base)-16:]
-}
-
-func init() {
-	_ = fmt.Sprintf
-}
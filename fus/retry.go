@@ -0,0 +1,121 @@
+package fus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// RetryPolicy controls how a Client retries failed requests. Delays grow
+// exponentially from BaseDelay up to MaxDelay, with random jitter.
+type RetryPolicy struct {
+	MaxAttempts int // total attempts per request; 1 disables retrying
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// DefaultRetryPolicy is used unless WithRetry is given.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   time.Second,
+	MaxDelay:    30 * time.Second,
+}
+
+// WithRetry sets the retry policy of the client.
+func WithRetry(p RetryPolicy) Option {
+	return func(c *Client) { c.retry = p }
+}
+
+// Retry returns the retry policy of the client.
+func (c *Client) Retry() RetryPolicy {
+	return c.retry
+}
+
+// Delay returns the jittered backoff before retry number attempt (from 1):
+// between half and all of BaseDelay doubled for every earlier retry, capped
+// at MaxDelay.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Equal jitter: half fixed, half random.
+	return d/2 + rand.N(d/2+1)
+}
+
+// Wait sleeps for Delay(attempt), returning early with the error of ctx if
+// it is cancelled.
+func (p RetryPolicy) Wait(ctx context.Context, attempt int) error {
+	return sleep(ctx, p.Delay(attempt))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// IsTemporary reports whether err is a transient failure worth retrying:
+// a network error, a truncated response or a busy server.
+func IsTemporary(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var opErr *net.OpError
+	var netErr net.Error
+	return errors.Is(err, ErrServerBusy) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF) ||
+		errors.As(err, &opErr) ||
+		errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// do runs op, retrying temporary failures with backoff. When the server
+// rejects the session, the nonce is renegotiated and the BinaryInform and
+// BinaryInit steps of the session are replayed before op runs again.
+func (c *Client) do(ctx context.Context, op func() error) error {
+	renew := false
+	epoch := 0
+	for attempt := 1; ; attempt++ {
+		var err error
+		if renew {
+			err = c.renewStale(ctx, epoch)
+		}
+		if err == nil {
+			renew = false
+			_, _, _, _, epoch = c.session()
+			err = op()
+		}
+		if err == nil {
+			return nil
+		}
+
+		if errors.Is(err, ErrAuth) {
+			renew = true
+		} else if !IsTemporary(err) {
+			return err
+		}
+		if attempt >= c.retry.MaxAttempts {
+			return err
+		}
+		delay := c.retry.Delay(attempt)
+		c.log.Warn("retrying fus request", "attempt", attempt, "delay", delay, "renew", renew, "err", err)
+		if werr := sleep(ctx, delay); werr != nil {
+			return werr
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package fus_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattchengg/susgo/fus"
+	"github.com/mattchengg/susgo/fustest"
+)
+
+func TestDelay(t *testing.T) {
+	p := fus.RetryPolicy{BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+	for attempt, hi := range map[int]time.Duration{
+		1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 5: 16 * time.Second,
+		6: 30 * time.Second, 10: 30 * time.Second, 100: 30 * time.Second,
+	} {
+		for i := 0; i < 100; i++ {
+			if d := p.Delay(attempt); d < hi/2 || d > hi {
+				t.Fatalf("Delay(%d) = %v, want between %v and %v", attempt, d, hi/2, hi)
+			}
+		}
+	}
+	if d := (fus.RetryPolicy{}).Delay(3); d != 0 {
+		t.Errorf("Delay without BaseDelay = %v, want 0", d)
+	}
+	if d := (fus.RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Second}).Delay(1); d > time.Second {
+		t.Errorf("Delay above MaxDelay: %v", d)
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTemporary(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.New("bad request"), false},
+		{context.Canceled, false},
+		{fmt.Errorf("read: %w", context.DeadlineExceeded), false},
+		{fus.ErrServerBusy, true},
+		{&fus.StatusError{Endpoint: "x", Status: 503, HTTP: true}, true},
+		{&fus.StatusError{Endpoint: "x", Status: 429, HTTP: true}, true},
+		{&fus.StatusError{Endpoint: "x", Status: 404, HTTP: true}, false},
+		{&fus.StatusError{Endpoint: "x", Status: 408}, false},
+		{fus.ErrAuth, false},
+		{fus.ErrNotFound, false},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("body: %w", io.EOF), true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{timeoutError{}, true},
+	}
+	for _, tt := range tests {
+		if got := fus.IsTemporary(tt.err); got != tt.want {
+			t.Errorf("IsTemporary(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// requestCounter counts the requests per endpoint.
+type requestCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (r *requestCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	r.counts[strings.TrimPrefix(req.URL.Path, "/")]++
+	r.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (r *requestCounter) count(endpoint string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[endpoint]
+}
+
+// newCountingClient returns a client of a new fustest.Server retrying up
+// to three attempts without noticeable delay, with the server and the
+// request counts.
+func newCountingClient(t *testing.T) (*fus.Client, *fustest.Server, *requestCounter) {
+	t.Helper()
+	srv, err := fustest.NewServer(fustest.Firmware{Model: "SM-S928B", Region: "EUX", Version: testVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	rc := &requestCounter{counts: map[string]int{}}
+	c, err := fus.NewClient(context.Background(), append(srv.FUSOptions(),
+		fus.WithHTTPClient(&http.Client{Transport: rc}),
+		fus.WithRetry(fus.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv, rc
+}
+
+func TestRetryTemporary(t *testing.T) {
+	c, srv, rc := newCountingClient(t)
+	ctx := context.Background()
+
+	srv.FailNext(2, http.StatusServiceUnavailable)
+	if _, err := c.BinaryInform(ctx, testVersion, "SM-S928B", "EUX", testIMEI); err != nil {
+		t.Fatalf("BinaryInform after two busy replies: %v", err)
+	}
+	if n := rc.count("NF_DownloadBinaryInform.do"); n != 3 {
+		t.Errorf("%d BinaryInform requests, want 3", n)
+	}
+
+	srv.FailNext(3, http.StatusServiceUnavailable)
+	if _, err := c.BinaryInform(ctx, testVersion, "SM-S928B", "EUX", testIMEI); !errors.Is(err, fus.ErrServerBusy) {
+		t.Errorf("BinaryInform after MaxAttempts busy replies = %v, want %v", err, fus.ErrServerBusy)
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	c, srv, rc := newCountingClient(t)
+	srv.FailNext(1, http.StatusNotFound)
+	_, err := c.BinaryInform(context.Background(), testVersion, "SM-S928B", "EUX", testIMEI)
+	var se *fus.StatusError
+	if !errors.As(err, &se) || se.Status != http.StatusNotFound {
+		t.Fatalf("BinaryInform = %v, want HTTP 404", err)
+	}
+	if n := rc.count("NF_DownloadBinaryInform.do"); n != 1 {
+		t.Errorf("%d BinaryInform requests for a permanent failure, want 1", n)
+	}
+}
+
+func TestRenewOnAuth(t *testing.T) {
+	c, srv, rc := newCountingClient(t)
+	ctx := context.Background()
+	info, err := c.BinaryInform(ctx, testVersion, "SM-S928B", "EUX", testIMEI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BinaryInit(ctx, info.BinaryName); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server forgets the session: the download is rejected, the nonce
+	// renegotiated and BinaryInform and BinaryInit replayed.
+	srv.ExpireSessions()
+	resp, err := c.DownloadRange(ctx, info.ModelPath+info.BinaryName, 0, 15)
+	if err != nil {
+		t.Fatalf("DownloadRange after the session expired: %v", err)
+	}
+	resp.Body.Close()
+	for endpoint, want := range map[string]int{
+		"NF_DownloadGenerateNonce.do":     2,
+		"NF_DownloadBinaryInform.do":      2,
+		"NF_DownloadBinaryInitForMass.do": 2,
+		"NF_DownloadBinaryForMass.do":     2,
+	} {
+		if n := rc.count(endpoint); n != want {
+			t.Errorf("%d %s requests, want %d", n, endpoint, want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package fustest
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/mattchengg/susgo/firmware"
+	"github.com/mattchengg/susgo/fota"
+	"github.com/mattchengg/susgo/internal/fusmsg"
+)
+
+// Firmware describes one firmware build served by a Server.
+type Firmware struct {
+	Model  string
+	Region string
+
+	// Version is normalized to the four-part form on registration. It
+	// must be at least 16 characters long, as LOGIC_CHECK and the .enc4
+	// key are derived from its first 16.
+	Version string
+
+	// EncVersion selects the .enc2 or .enc4 format; zero means 4.
+	EncVersion int
+
+	// Files are the zip members. If nil, AP/BL/CP/CSC/HOME_CSC tar.md5
+	// members of MemberSize pseudo-random bytes are generated.
+	Files      map[string][]byte
+	MemberSize int
+
+	// Deflate names the members of Files that are compressed rather than
+	// stored, as some firmware zips do with small members.
+	Deflate []string
+}
+
+// build is a registered Firmware with its generated payload.
+type build struct {
+	Firmware
+	logicValue string
+	binaryName string
+	modelPath  string
+	plaintext  []byte
+	ciphertext []byte
+	md5        [16]byte
+	crc        uint32
+}
+
+func newBuild(fw Firmware, rng *rand.Rand) (*build, error) {
+	fw.Version = fota.NormalizeVersion(fw.Version)
+	if len(fw.Version) < 16 {
+		return nil, fmt.Errorf("fustest: version %q is shorter than 16 characters", fw.Version)
+	}
+	if fw.EncVersion == 0 {
+		fw.EncVersion = 4
+	}
+	if fw.MemberSize == 0 {
+		fw.MemberSize = 64 * 1024
+	}
+
+	b := &build{
+		Firmware:   fw,
+		logicValue: fusmsg.RandomString(rng, 16),
+		modelPath:  fmt.Sprintf("/neofus/9/%s/", fw.Model),
+	}
+	pda := strings.SplitN(fw.Version, "/", 2)[0]
+	b.binaryName = fmt.Sprintf("%s_1_20240101000000_%s_fac.zip.enc%d", fw.Model, fusmsg.RandomString(rng, 10), fw.EncVersion)
+
+	files := fw.Files
+	if files == nil {
+		files = map[string][]byte{}
+		for _, part := range []string{"AP", "BL", "CP", "CSC", "HOME_CSC"} {
+			data := make([]byte, fw.MemberSize)
+			rng.Read(data)
+			files[fmt.Sprintf("%s_%s_%s.tar.md5", part, pda, pda)] = data
+		}
+	}
+
+	var err error
+	if b.plaintext, err = buildZip(files, fw.Deflate); err != nil {
+		return nil, err
+	}
+	key, err := b.key()
+	if err != nil {
+		return nil, err
+	}
+	if b.ciphertext, err = encryptECB(b.plaintext, key); err != nil {
+		return nil, err
+	}
+	b.md5 = md5.Sum(b.ciphertext)
+	b.crc = crc32.ChecksumIEEE(b.ciphertext)
+	return b, nil
+}
+
+// key returns the key the client is expected to derive for this build.
+func (b *build) key() ([]byte, error) {
+	if b.EncVersion == 2 {
+		return firmware.V2Key(b.Version, b.Model, b.Region), nil
+	}
+	return firmware.V4Key(b.Version, b.logicValue)
+}
+
+func buildZip(files map[string][]byte, deflate []string) ([]byte, error) {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		method := zip.Store
+		if slices.Contains(deflate, name) {
+			method = zip.Deflate
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encryptECB(plaintext, key []byte) ([]byte, error) {
+	c, err := firmware.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	data := firmware.Pad(plaintext)
+	c.Encrypt(data)
+	return data, nil
+}
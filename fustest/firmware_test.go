@@ -0,0 +1,9 @@
+package fustest
+
+import "testing"
+
+func TestShortVersion(t *testing.T) {
+	if _, err := NewServer(Firmware{Model: "SM-S928B", Region: "EUX", Version: "S928BXXS4CYK8"}); err == nil {
+		t.Error("NewServer accepted a version shorter than 16 characters")
+	}
+}
@@ -0,0 +1,480 @@
+// Package fustest provides an in-process fake of the FUS and FOTA services
+// for offline end-to-end testing, in the spirit of net/http/httptest.
+//
+// A Server speaks the same protocol as the real hosts: it hands out encrypted
+// nonces, checks LOGIC_CHECK values and Authorization signatures, answers
+// BinaryInform/BinaryInitForMass with FUSMsg replies and serves a genuinely
+// AES-encrypted firmware zip with Range support.
+package fustest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattchengg/susgo/fota"
+	"github.com/mattchengg/susgo/fus"
+	"github.com/mattchengg/susgo/internal/fusmsg"
+)
+
+// Server is a fake FUS/FOTA server. Point clients at it with FUSOptions and
+// FOTAOptions.
+type Server struct {
+	*httptest.Server
+
+	// CheckIMEI reports whether the server accepts an IMEI or serial. If nil,
+	// all-digit values must be 15-digit Luhn-valid IMEIs and anything else is
+	// accepted as a serial.
+	CheckIMEI func(imei string) bool
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	builds   []*build
+	sessions map[string]*session // by JSESSIONID
+	byNonce  map[string]*session // by encrypted nonce
+	failures []int               // HTTP statuses for the next requests
+	rate     int64               // download bytes per second per connection
+	drop     chan struct{}       // closed to abort the downloads in progress
+}
+
+type session struct {
+	id       string
+	nonce    string
+	encNonce string
+	inited   map[string]bool // BINARY_NAME authorized by BinaryInitForMass
+}
+
+// NewServer starts a Server serving fws. The caller must call Close.
+func NewServer(fws ...Firmware) (*Server, error) {
+	s := &Server{
+		rng:      rand.New(rand.NewSource(1)),
+		sessions: map[string]*session{},
+		byNonce:  map[string]*session{},
+		drop:     make(chan struct{}),
+	}
+	for _, fw := range fws {
+		if err := s.Add(fw); err != nil {
+			return nil, err
+		}
+	}
+	s.Server = httptest.NewServer(s)
+	return s, nil
+}
+
+// Add registers another firmware build. The most recently added version of a
+// model and region is announced as the latest one.
+func (s *Server) Add(fw Firmware) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, err := newBuild(fw, s.rng)
+	if err != nil {
+		return err
+	}
+	s.builds = append(s.builds, b)
+	return nil
+}
+
+// FUSOptions returns the options that point a fus.Client at s.
+func (s *Server) FUSOptions() []fus.Option {
+	return []fus.Option{fus.WithBaseURL(s.URL), fus.WithDownloadURL(s.URL)}
+}
+
+// FOTAOptions returns the options that point a fota.Client at s.
+func (s *Server) FOTAOptions() []fota.Option {
+	return []fota.Option{fota.WithBaseURL(s.URL)}
+}
+
+// Plaintext returns the decrypted firmware zip for model, region and version.
+func (s *Server) Plaintext(model, region, version string) []byte {
+	if b := s.find(model, region, version); b != nil {
+		return b.plaintext
+	}
+	return nil
+}
+
+// Ciphertext returns the encrypted firmware file for model, region and
+// version, as served by NF_DownloadBinaryForMass.do.
+func (s *Server) Ciphertext(model, region, version string) []byte {
+	if b := s.find(model, region, version); b != nil {
+		return b.ciphertext
+	}
+	return nil
+}
+
+func (s *Server) find(model, region, version string) *build {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version = fota.NormalizeVersion(version)
+	for _, b := range s.builds {
+		if b.Model == model && b.Region == region && b.Version == version {
+			return b
+		}
+	}
+	return nil
+}
+
+// ExpireSessions forgets every session, so subsequent requests and downloads
+// are rejected until the client negotiates a new nonce.
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = map[string]*session{}
+	s.byNonce = map[string]*session{}
+}
+
+// FailNext makes the next n requests fail with the given HTTP status.
+func (s *Server) FailNext(n, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, status)
+	}
+}
+
+// Disconnect aborts every download in progress, as a network failure
+// would. The sessions stay valid.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	close(s.drop)
+	s.drop = make(chan struct{})
+}
+
+// Throttle limits every download connection to bps bytes per second; zero
+// removes the limit.
+func (s *Server) Throttle(bps int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rate = bps
+}
+
+var versionXMLPath = regexp.MustCompile(`^/firmware/([^/]+)/([^/]+)/version\.xml$`)
+
+// ServeHTTP dispatches to the FUS and FOTA endpoints.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	if len(s.failures) > 0 {
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		s.mu.Unlock()
+		w.WriteHeader(status)
+		return
+	}
+	s.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/NF_DownloadGenerateNonce.do":
+		s.generateNonce(w, r)
+	case "/NF_DownloadBinaryInform.do":
+		s.binaryInform(w, r)
+	case "/NF_DownloadBinaryInitForMass.do":
+		s.binaryInit(w, r)
+	case "/NF_DownloadBinaryForMass.do":
+		s.download(w, r)
+	default:
+		if m := versionXMLPath.FindStringSubmatch(r.URL.Path); m != nil {
+			s.versionXML(w, m[1], m[2])
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) generateNonce(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess := &session{
+		id:     fusmsg.RandomString(s.rng, 32),
+		nonce:  fusmsg.RandomString(s.rng, 16),
+		inited: map[string]bool{},
+	}
+	enc, err := fus.EncryptNonce(sess.nonce)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sess.encNonce = enc
+	s.sessions[sess.id] = sess
+	s.byNonce[enc] = sess
+
+	http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: sess.id})
+	w.Header().Set("NONCE", enc)
+}
+
+// session returns the session named by the request cookie after checking the
+// Authorization signature, or nil.
+func (s *Server) session(r *http.Request) *session {
+	cookie, err := r.Cookie("JSESSIONID")
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	sess := s.sessions[cookie.Value]
+	s.mu.Unlock()
+	if sess == nil {
+		return nil
+	}
+	sig, err := fus.Signature(sess.nonce)
+	if err != nil || authParam(r, "signature") != sig {
+		return nil
+	}
+	return sess
+}
+
+func (s *Server) binaryInform(w http.ResponseWriter, r *http.Request) {
+	sess := s.session(r)
+	if sess == nil {
+		writeStatus(w, 401)
+		return
+	}
+	put, err := fusmsg.ReadPut(r.Body)
+	if err != nil {
+		writeStatus(w, 400)
+		return
+	}
+
+	fwv := put["DEVICE_FW_VERSION"]
+	if put["LOGIC_CHECK"] != fus.LogicCheck(fwv, sess.nonce) {
+		writeStatus(w, 401)
+		return
+	}
+	if !s.checkIMEI(put["DEVICE_IMEI_PUSH"]) {
+		writeStatus(w, 408)
+		return
+	}
+
+	model, region := put["DEVICE_MODEL_NAME"], put["DEVICE_LOCAL_CODE"]
+	if !s.known(model, region) {
+		writeStatus(w, 400)
+		return
+	}
+	b := s.find(model, region, fwv)
+	if b == nil {
+		writeStatus(w, 404)
+		return
+	}
+
+	fusmsg.Write(w, 200, map[string]string{"LATEST_FW_VERSION": b.Version}, map[string]string{
+		"BINARY_NAME":         b.binaryName,
+		"BINARY_BYTE_SIZE":    fmt.Sprint(len(b.ciphertext)),
+		"BINARY_CRC":          fmt.Sprint(b.crc),
+		"MODEL_PATH":          b.modelPath,
+		"LOGIC_VALUE_FACTORY": b.logicValue,
+		"DEVICE_MODEL_NAME":   b.Model,
+		"DEVICE_LOCAL_CODE":   b.Region,
+	})
+}
+
+func (s *Server) binaryInit(w http.ResponseWriter, r *http.Request) {
+	sess := s.session(r)
+	if sess == nil {
+		writeStatus(w, 401)
+		return
+	}
+	put, err := fusmsg.ReadPut(r.Body)
+	if err != nil {
+		writeStatus(w, 400)
+		return
+	}
+
+	name := put["BINARY_FILE_NAME"]
+	b := s.byName(name)
+	if b == nil {
+		writeStatus(w, 404)
+		return
+	}
+	if put["LOGIC_CHECK"] != fus.LogicCheck(initCheckInput(name), sess.nonce) {
+		writeStatus(w, 401)
+		return
+	}
+
+	s.mu.Lock()
+	sess.inited[name] = true
+	s.mu.Unlock()
+	writeStatus(w, 200)
+}
+
+// initCheckInput mirrors the LOGIC_CHECK input the client derives from a
+// binary name: the last 16 characters before the extension.
+func initCheckInput(name string) string {
+	if len(name) <= 16 {
+		return name
+	}
+	base := name
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		base = name[:i]
+	}
+	if len(base) < 16 {
+		return name
+	}
+	return base[len(base)-16:]
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	file := r.URL.Query().Get("file")
+	name := file[strings.LastIndex(file, "/")+1:]
+	b := s.byName(name)
+	if b == nil || b.modelPath+b.binaryName != file {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	sess := s.byNonce[authParam(r, "nonce")]
+	authorized := sess != nil && sess.inited[name]
+	s.mu.Unlock()
+	if authorized {
+		sig, err := fus.Signature(sess.nonce)
+		authorized = err == nil && authParam(r, "signature") == sig
+	}
+	if !authorized {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	rate, drop := s.rate, s.drop
+	s.mu.Unlock()
+
+	w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(b.md5[:]))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w = &throttledWriter{ResponseWriter: w, rate: rate, drop: drop}
+	http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(b.ciphertext))
+}
+
+// throttledWriter paces writes to rate bytes per second, if rate is
+// non-zero, and aborts the connection once drop is closed.
+type throttledWriter struct {
+	http.ResponseWriter
+	rate int64
+	drop <-chan struct{}
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	if w.rate <= 0 {
+		w.check()
+		return w.ResponseWriter.Write(p)
+	}
+	written := 0
+	for len(p) > 0 {
+		w.check()
+		n := min(len(p), int(max(w.rate/10, 1)))
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		if f, ok := w.ResponseWriter.(http.Flusher); ok {
+			f.Flush()
+		}
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(w.rate))
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (w *throttledWriter) check() {
+	select {
+	case <-w.drop:
+		panic(http.ErrAbortHandler)
+	default:
+	}
+}
+
+func (s *Server) versionXML(w http.ResponseWriter, region, model string) {
+	s.mu.Lock()
+	var matching []*build
+	for _, b := range s.builds {
+		if b.Model == model && b.Region == region {
+			matching = append(matching, b)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(matching) == 0 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?><versioninfo><firmware><version>`)
+	latest := matching[len(matching)-1]
+	fmt.Fprintf(&buf, `<latest o="14">%s</latest><upgrade>`, fusmsg.Escape(latest.Version))
+	for _, b := range matching[:len(matching)-1] {
+		fmt.Fprintf(&buf, `<value rcount="1" fwsize="%d">%s</value>`, len(b.ciphertext), fusmsg.Escape(b.Version))
+	}
+	buf.WriteString(`</upgrade></version></firmware></versioninfo>`)
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buf.Bytes())
+}
+
+func (s *Server) known(model, region string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.builds {
+		if b.Model == model && b.Region == region {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) byName(name string) *build {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.builds {
+		if b.binaryName == name {
+			return b
+		}
+	}
+	return nil
+}
+
+func (s *Server) checkIMEI(imei string) bool {
+	if s.CheckIMEI != nil {
+		return s.CheckIMEI(imei)
+	}
+	if strings.Trim(imei, "0123456789") != "" {
+		return imei != ""
+	}
+	return len(imei) == 15 && luhnValid(imei)
+}
+
+func luhnValid(imei string) bool {
+	sum := 0
+	for i := range imei {
+		d := int(imei[len(imei)-1-i] - '0')
+		if i%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+var authParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authParam extracts a parameter from the FUS Authorization header.
+func authParam(r *http.Request, name string) string {
+	for _, m := range authParamRe.FindAllStringSubmatch(r.Header.Get("Authorization"), -1) {
+		if m[1] == name {
+			return m[2]
+		}
+	}
+	return ""
+}
+
+func writeStatus(w http.ResponseWriter, status int) {
+	fusmsg.Write(w, status, nil, nil)
+}
@@ -0,0 +1,118 @@
+// Package imei generates Luhn-valid IMEIs from a TAC and finds one the FUS
+// server accepts for a given model and region.
+package imei
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+
+	"github.com/mattchengg/susgo/fus"
+)
+
+// LuhnChecksum returns the check digit that completes the 14-digit imei.
+func LuhnChecksum(imei string) int {
+	imei += "0"
+	parity := len(imei) % 2
+	s := 0
+	for idx, char := range imei {
+		d := int(char - '0')
+		if idx%2 == parity {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		s += d
+	}
+	return (10 - (s % 10)) % 10
+}
+
+// Generate returns n random IMEIs sharing the 8-digit tac.
+func Generate(tac string, n int) []string {
+	imeiNumbers := make([]string, 0, n)
+
+	firstDigitChoices := []int{0, 5, 7}
+	thirdDigitChoices := []int{0, 1, 3, 5, 6, 7}
+
+	for i := 0; i < n; i++ {
+		rngFirst := firstDigitChoices[rand.Intn(len(firstDigitChoices))]
+		rngSecond := rand.Intn(6) + 4 // 4-9
+		rngThird := thirdDigitChoices[rand.Intn(len(thirdDigitChoices))]
+		rngFourth := rand.Intn(10)
+		rngFifthSixth := rand.Intn(100)
+
+		tacRng := fmt.Sprintf("%s%d%d%d%d%02d", tac, rngFirst, rngSecond, rngThird, rngFourth, rngFifthSixth)
+		luhnDigit := LuhnChecksum(tacRng)
+		imei := fmt.Sprintf("%s%d", tacRng, luhnDigit)
+
+		imeiNumbers = append(imeiNumbers, imei)
+	}
+
+	return imeiNumbers
+}
+
+// Random returns tac unchanged if it is already a full IMEI, or a random IMEI
+// generated from an 8-digit TAC. It returns "" for any other length.
+func Random(tac string) string {
+	if len(tac) == 15 {
+		return tac
+	} else if len(tac) == 8 {
+		imeis := Generate(tac, 1)
+		if len(imeis) > 0 {
+			return imeis[0]
+		}
+	}
+	return ""
+}
+
+// ValidateAndGenerate returns an IMEI for the 8-digit tac that the FUS server
+// accepts for firmware version fwVer of model and region, which the caller
+// resolves, e.g. with its fota.Client. A 15-digit tac is returned as is. If
+// report is non-nil it is called after every attempt with the candidate IMEI
+// and the reason it was rejected, or nil if accepted. opts configure the FUS
+// client created for every attempt.
+func ValidateAndGenerate(ctx context.Context, tac, fwVer, model, region string, report func(attempt int, imei string, err error), opts ...fus.Option) (string, error) {
+	if len(tac) == 15 {
+		return tac, nil
+	}
+
+	if len(tac) != 8 {
+		return "", fmt.Errorf("invalid IMEI length: please provide 8 or 15 digits")
+	}
+
+	if report == nil {
+		report = func(int, string, error) {}
+	}
+
+	if fwVer == "" {
+		return "", fmt.Errorf("firmware version required to validate an IMEI")
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= 5; attempt++ {
+		imei := Random(tac)
+		client, err := fus.NewClient(ctx, opts...)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = client.BinaryInform(ctx, fwVer, model, region, imei)
+		if err == nil {
+			report(attempt, imei, nil)
+			return imei, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if errors.Is(err, fus.ErrUnknownModel) {
+			return "", err
+		}
+
+		report(attempt, imei, err)
+		lastErr = err
+	}
+
+	return "", fmt.Errorf("unable to find a valid IMEI after 5 tries: %w", lastErr)
+}
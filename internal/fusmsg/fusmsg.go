@@ -0,0 +1,69 @@
+// Package fusmsg is the server side of the FUSMsg documents exchanged with
+// the FUS endpoints, shared by the fake and the caching servers.
+package fusmsg
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// ReadPut decodes the Put parameters of a FUSMsg request.
+func ReadPut(body io.Reader) (map[string]string, error) {
+	var msg struct {
+		Body struct {
+			Put struct {
+				Elements []struct {
+					XMLName xml.Name
+					Data    string `xml:"Data"`
+				} `xml:",any"`
+			} `xml:"Put"`
+		} `xml:"FUSBody"`
+	}
+	if err := xml.NewDecoder(body).Decode(&msg); err != nil {
+		return nil, err
+	}
+	put := make(map[string]string, len(msg.Body.Put.Elements))
+	for _, e := range msg.Body.Put.Elements {
+		put[e.XMLName.Local] = e.Data
+	}
+	return put, nil
+}
+
+// Write replies with a FUSMsg of status and the given Results and Put
+// parameters.
+func Write(w http.ResponseWriter, status int, results, put map[string]string) {
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?><FUSMsg><FUSHdr><ProtoVer>1.0</ProtoVer></FUSHdr><FUSBody><Results>`)
+	for name, data := range results {
+		fmt.Fprintf(&buf, "<%s><Data>%s</Data></%s>", name, Escape(data), name)
+	}
+	fmt.Fprintf(&buf, "<Status>%d</Status></Results><Put>", status)
+	for name, data := range put {
+		fmt.Fprintf(&buf, "<%s><Data>%s</Data></%s>", name, Escape(data), name)
+	}
+	buf.WriteString("</Put></FUSBody></FUSMsg>")
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buf.Bytes())
+}
+
+// Escape returns s escaped for XML character data.
+func Escape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// RandomString returns n lowercase letters and digits drawn from r, as used
+// for nonces, session IDs and file names.
+func RandomString(r io.Reader, n int) string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	io.ReadFull(r, b)
+	for i := range b {
+		b[i] = chars[int(b[i])%len(chars)]
+	}
+	return string(b)
+}
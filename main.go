@@ -1,61 +1,184 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"crypto/aes"
 	"encoding/base64"
-	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mattchengg/susgo/cache"
+	"github.com/mattchengg/susgo/download"
+	"github.com/mattchengg/susgo/firmware"
+	"github.com/mattchengg/susgo/fota"
+	"github.com/mattchengg/susgo/fus"
+	"github.com/mattchengg/susgo/imei"
+	"github.com/mattchengg/susgo/transport"
 )
 
 var (
-	model    string
-	region   string
-	imei     string
-	serial   string
-	version  string
-	outDir   string
-	outFile  string
-	inFile   string
-	encVer   int
-	showMD5  bool
-	latest   bool
-	quiet    bool
+	model       string
+	region      string
+	imeiArg     string
+	serial      string
+	version     string
+	outDir      string
+	outFile     string
+	inFile      string
+	encVer      int
+	showMD5     bool
+	connections int
+	decryptLive bool
+	keepEnc     bool
+	limiter     download.Limiter
+	stallTime   time.Duration
+	minSpeed    int64 = 1 << 10
+	workers     int
+	latest      bool
+	quiet       bool
+
+	fusURL      string
+	downloadURL string
+	fotaURL     string
+	httpConfig  transport.Config
+	retries     int
+	verbose     bool
+	noRedact    bool
+	noSpace     bool
+	cacheDir    string
+
+	fotaClient *fota.Client
+	fwCache    *cache.Cache
+	fusOpts    []fus.Option
 )
 
 func main() {
 	flag.StringVar(&model, "m", "", "Device model (required)")
 	flag.StringVar(&region, "r", "", "Device region code (required)")
-	flag.StringVar(&imei, "i", "", "Device IMEI or TAC (8 digits)")
+	flag.StringVar(&imeiArg, "i", "", "Device IMEI or TAC (8 digits)")
 	flag.StringVar(&serial, "s", "", "Device Serial Number")
+	flag.StringVar(&fusURL, "fus-url", envOr("SUSGO_FUS_URL", fus.DefaultBaseURL), "FUS server base URL")
+	flag.StringVar(&downloadURL, "download-url", envOr("SUSGO_DOWNLOAD_URL", fus.DefaultDownloadURL), "Firmware download base URL")
+	flag.StringVar(&fotaURL, "fota-url", envOr("SUSGO_FOTA_URL", fota.DefaultBaseURL), "FOTA version.xml base URL")
+	flag.StringVar(&httpConfig.Proxy, "proxy", "", "HTTP, HTTPS or SOCKS5 proxy URL")
+	flag.StringVar(&httpConfig.CAFile, "ca-file", "", "Extra PEM CA bundle to trust")
+	flag.DurationVar(&httpConfig.ConnectTimeout, "connect-timeout", transport.DefaultConnectTimeout, "Connect and TLS handshake timeout")
+	flag.DurationVar(&httpConfig.HeaderTimeout, "header-timeout", transport.DefaultHeaderTimeout, "Response header timeout")
+	flag.DurationVar(&httpConfig.ReadTimeout, "read-timeout", transport.DefaultReadTimeout, "Idle read timeout")
+	flag.IntVar(&retries, "retries", fus.DefaultRetryPolicy.MaxAttempts-1, "Retries per FUS request")
+	flag.BoolVar(&verbose, "verbose", false, "Log the FUS conversation to stderr")
+	flag.BoolVar(&noRedact, "no-redact", false, "Do not redact IMEI, serial and signatures in logs")
+	flag.BoolVar(&noSpace, "no-space-check", false, "Skip the free disk space check")
+	flag.StringVar(&cacheDir, "cache-dir", os.Getenv("SUSGO_CACHE_DIR"), "Shared firmware cache directory")
 	flag.Parse()
 
+	hc, err := transport.NewClient(httpConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(exitError)
+	}
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	fotaClient = fota.NewClient(fota.WithBaseURL(fotaURL), fota.WithHTTPClient(hc), fota.WithLogger(logger))
+	retry := fus.DefaultRetryPolicy
+	retry.MaxAttempts = retries + 1
+	fusOpts = []fus.Option{fus.WithBaseURL(fusURL), fus.WithDownloadURL(downloadURL), fus.WithHTTPClient(hc), fus.WithRetry(retry), fus.WithLogger(logger)}
+	if noRedact {
+		fusOpts = append(fusOpts, fus.WithUnredactedLogs())
+	}
+
+	if cacheDir != "" {
+		if fwCache, err = cache.Open(cacheDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(exitError)
+		}
+	}
+
 	args := flag.Args()
-	if len(args) == 0 || model == "" || region == "" {
+	if len(args) == 0 || args[0] != "batch" && args[0] != "serve-cache" && (model == "" || region == "") {
 		printUsage()
 		os.Exit(1)
 	}
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	switch args[0] {
 	case "checkupdate":
-		checkUpdate()
+		err = checkUpdate(ctx)
 	case "list":
 		parseListFlags(args[1:])
-		listFirmware()
+		err = listFirmware(ctx)
 	case "download":
 		parseDownloadFlags(args[1:])
-		download()
+		err = downloadFirmware(ctx)
+	case "batch":
+		err = runBatch(ctx, parseBatchFlags(args[1:]), os.Stdout)
+	case "remote":
+		sub, member := parseRemoteFlags(args[1:])
+		err = remote(ctx, sub, member)
+	case "serve-cache":
+		parseServeFlags(args[1:])
+		err = serveCache(ctx, hc)
 	case "decrypt":
 		parseDecryptFlags(args[1:])
-		decrypt()
+		err = decrypt(ctx)
 	default:
 		fmt.Printf("Unknown command: %s\n", args[0])
 		printUsage()
 		os.Exit(1)
 	}
+
+	if err != nil {
+		stop()
+		os.Exit(reportError(err))
+	}
+}
+
+// parseRate parses a byte rate such as 500000, 500K, 2M or 1.5MB/s, with
+// binary multiples.
+func parseRate(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S"), "B")
+	mult := 1.0
+	if i := strings.IndexAny(v, "KMG"); i >= 0 && i == len(v)-1 {
+		mult = map[byte]float64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30}[v[i]]
+		v = v[:i]
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(n * mult), nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func newFUSClient(ctx context.Context) (*fus.Client, error) {
+	return fus.NewClient(ctx, fusOpts...)
 }
 
 func printUsage() {
@@ -64,8 +187,12 @@ func printUsage() {
 Usage:
   susgo -m <model> -r <region> checkupdate
   susgo -m <model> -r <region> list [-l] [-q]
-  susgo -m <model> -r <region> -i <IMEI/TAC> download [-O <dir> | -o <file>] [-v <ver>]
+  susgo -m <model> -r <region> -i <IMEI/TAC> download [-O <dir> | -o <file>] [-v <ver>] [-c <n>]
   susgo -m <model> -r <region> -i <IMEI/TAC> decrypt -v <ver> -I <input> -o <output>
+  susgo -m <model> -r <region> -i <IMEI/TAC> remote ls [-v <ver>]
+  susgo -m <model> -r <region> -i <IMEI/TAC> remote get [-v <ver>] [-o <file|dir|->] <member>
+  susgo batch [-j <n>] [-job-retries <n>] [-c <n>] [-d] [-k] <manifest.json|yaml>
+  susgo serve-cache [-listen <addr>] [-dir <dir>] [-limit <rate>]
 
 Options:
   -m  Device model (e.g., SM-S928B)
@@ -73,11 +200,29 @@ Options:
   -i  IMEI (15 digits) or TAC (8 digits)
   -s  Serial Number (for devices without IMEI)
 
+  -fus-url       FUS server base URL ($SUSGO_FUS_URL)
+  -download-url  Firmware download base URL ($SUSGO_DOWNLOAD_URL)
+  -fota-url      FOTA version.xml base URL ($SUSGO_FOTA_URL)
+
+  -proxy            HTTP, HTTPS or SOCKS5 proxy URL (default: $HTTPS_PROXY)
+  -ca-file          Extra PEM CA bundle to trust
+  -connect-timeout  Connect and TLS handshake timeout (default 15s)
+  -header-timeout   Response header timeout (default 30s)
+  -read-timeout     Idle read timeout (default 1m)
+  -retries          Retries per FUS request, with backoff (default 4)
+  -verbose          Log the FUS conversation to stderr
+  -no-redact        Do not redact IMEI, serial and signatures in logs
+  -no-space-check   Skip the free disk space check before download and decrypt
+  -cache-dir        Shared firmware cache directory ($SUSGO_CACHE_DIR)
+
 Commands:
   checkupdate  Check latest firmware version
   list         List all available firmware versions
   download     Download firmware
   decrypt      Decrypt encrypted firmware
+  remote       List or fetch single files of the firmware zip on the server
+  batch        Download every firmware listed in a JSON or YAML manifest
+  serve-cache  Run a caching proxy that other susgo instances download from
 
 List Options:
   -l  Show only latest version
@@ -85,15 +230,45 @@ List Options:
 
 Download Options:
   -O  Output directory
-  -o  Output file
+  -o  Output file, or - to stream to stdout (decrypted with -d)
   -v  Firmware version (optional)
   -M  Show MD5 hash
+  -c  Concurrent connections (default 1)
+  -d  Decrypt while downloading, without an intermediate encrypted file
+  -k  Keep the encrypted file after decrypting
+  -limit       Bandwidth limit in bytes/s for all connections (e.g. 500K, 2M)
+  -full-speed  Daily windows in which -limit does not apply (e.g. 20:00-07:00)
+  -workers     Decryption workers after download (default: one per CPU)
+  -stall-timeout  Reconnect a connection receiving no data for this long (default 1m)
+  -min-speed      Reconnect a connection slower than this over -stall-timeout,
+                  not counting -limit (default 1K; 0 disables)
 
 Decrypt Options:
   -v  Firmware version
-  -I  Input file
-  -o  Output file
-  -V  Encryption version (2 or 4, default 4)
+  -I  Input file, or - for stdin
+  -o  Output file, or - for stdout
+  -V  Encryption version (2 or 4, default: detected from the file)
+  -workers  Decryption workers for a file (default: one per CPU)
+
+Remote Options:
+  -v  Firmware version (optional)
+  -o  Output file or directory for get, or - for stdout (default: member name)
+  A member may be given by a unique prefix, e.g. CSC or BL.
+
+Batch Options:
+  -j            Jobs run at the same time (default: manifest concurrency, else 1)
+  -job-retries  Retries of a job failing with a network or server error
+                (default: manifest retries, else 0)
+  -M -c -d -k -limit -full-speed -workers -stall-timeout -min-speed
+                As for download, applied to every job; -limit is shared by
+                all jobs
+
+Serve-cache Options:
+  -listen  Address to listen on (default :8080)
+  -dir     Cache directory (default: -cache-dir)
+  -limit   Bandwidth limit in bytes/s for upstream downloads
+  -stall-timeout -min-speed  As for download, for upstream downloads
+  Upstream servers are set with -fus-url, -download-url and -fota-url.
 `)
 }
 
@@ -109,12 +284,43 @@ func parseDownloadFlags(args []string) {
 	fs.StringVar(&version, "v", "", "Firmware version")
 	fs.StringVar(&outDir, "O", "", "Output directory")
 	fs.StringVar(&outFile, "o", "", "Output file")
-	fs.BoolVar(&showMD5, "M", false, "Show MD5 hash")
+	addTransferFlags(fs)
 	fs.Parse(args)
 	if outDir == "" && outFile == "" {
 		fmt.Println("Error: -O or -o required")
 		os.Exit(1)
 	}
+	if outFile == "-" && keepEnc {
+		fmt.Println("Error: -k cannot be used with -o -")
+		os.Exit(1)
+	}
+}
+
+// addTransferFlags defines the flags shared by download and batch.
+func addTransferFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&showMD5, "M", false, "Show MD5 hash")
+	fs.IntVar(&connections, "c", 1, "Concurrent connections")
+	fs.BoolVar(&decryptLive, "d", false, "Decrypt while downloading")
+	fs.BoolVar(&keepEnc, "k", false, "Keep the encrypted file")
+	fs.Func("limit", "Bandwidth limit in bytes/s (K, M, G suffixes)", func(s string) (err error) {
+		limiter.Rate, err = parseRate(s)
+		return err
+	})
+	fs.Func("full-speed", "Daily HH:MM-HH:MM windows without -limit", func(s string) (err error) {
+		limiter.FullSpeed, err = download.ParseWindows(s)
+		return err
+	})
+	fs.IntVar(&workers, "workers", 0, "Decryption workers (default: one per CPU)")
+	addStallFlags(fs)
+}
+
+// addStallFlags defines the flags of the stalled connection watchdog.
+func addStallFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&stallTime, "stall-timeout", download.DefaultStallWindow, "Reconnect after receiving no data for this long")
+	fs.Func("min-speed", "Reconnect below this many bytes/s over -stall-timeout (default 1K)", func(s string) (err error) {
+		minSpeed, err = parseRate(s)
+		return err
+	})
 }
 
 func parseDecryptFlags(args []string) {
@@ -122,28 +328,32 @@ func parseDecryptFlags(args []string) {
 	fs.StringVar(&version, "v", "", "Firmware version")
 	fs.StringVar(&inFile, "I", "", "Input file")
 	fs.StringVar(&outFile, "o", "", "Output file")
-	fs.IntVar(&encVer, "V", 4, "Encryption version")
+	fs.IntVar(&encVer, "V", 0, "Encryption version, 2 or 4 (default: detected)")
+	fs.IntVar(&workers, "workers", 0, "Decryption workers (default: one per CPU)")
 	fs.Parse(args)
 	if version == "" || inFile == "" || outFile == "" {
 		fmt.Println("Error: -v, -I, -o required")
 		os.Exit(1)
 	}
+	if encVer != 0 && encVer != 2 && encVer != 4 {
+		fmt.Println("Error: -V must be 2 or 4")
+		os.Exit(1)
+	}
 }
 
-func checkUpdate() {
-	ver, err := getLatestVersion(model, region)
+func checkUpdate(ctx context.Context) error {
+	ver, err := fotaClient.LatestVersion(ctx, model, region)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 	fmt.Println(ver)
+	return nil
 }
 
-func listFirmware() {
-	info, err := getVersionInfo(model, region)
+func listFirmware(ctx context.Context) error {
+	info, err := fotaClient.GetVersionInfo(ctx, model, region)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 
 	if quiet {
@@ -153,7 +363,7 @@ func listFirmware() {
 				fmt.Println(u.Version)
 			}
 		}
-		return
+		return nil
 	}
 
 	fmt.Printf("Model: %s  Region: %s\n\n", model, region)
@@ -170,212 +380,533 @@ func listFirmware() {
 			fmt.Printf("  %s%s\n", u.Version, sizeStr)
 		}
 	}
+	return nil
 }
 
-func download() {
-	effectiveIMEI, err := parseIMEI()
+// fwJob is one firmware download. The download command fills it from its
+// flags, the batch command from a manifest entry.
+type fwJob struct {
+	Model   string
+	Region  string
+	IMEI    string // IMEI or TAC
+	Serial  string
+	Version string // empty for the latest
+	OutDir  string
+	OutFile string
+
+	out      io.Writer // job messages
+	progress bool      // draw a progress bar on stdout
+	result   string    // path of the finished file
+}
+
+// cliJob returns the job described by the global flags. Its messages go to
+// stderr when the output is "-", i.e. stdout.
+func cliJob() *fwJob {
+	out := os.Stdout
+	if outFile == "-" {
+		out = os.Stderr
+	}
+	return &fwJob{
+		Model:    model,
+		Region:   region,
+		IMEI:     imeiArg,
+		Serial:   serial,
+		Version:  version,
+		OutDir:   outDir,
+		OutFile:  outFile,
+		out:      out,
+		progress: true,
+	}
+}
+
+func downloadFirmware(ctx context.Context) error {
+	return cliJob().download(ctx)
+}
+
+func (j *fwJob) download(ctx context.Context) error {
+	effectiveIMEI, err := j.deviceID(ctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return err
 	}
 
-	client := NewFUSClient()
+	client, err := newFUSClient(ctx)
+	if err != nil {
+		return err
+	}
 
-	if version == "" {
-		ver, err := getLatestVersion(model, region)
+	if j.Version == "" {
+		ver, err := fotaClient.LatestVersion(ctx, j.Model, j.Region)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+			return err
 		}
-		version = ver
+		j.Version = ver
 	}
 
-	path, filename, size, err := getBinaryFile(client, version, model, region, effectiveIMEI)
+	info, err := client.BinaryInform(ctx, j.Version, j.Model, j.Region, effectiveIMEI)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return err
+	}
+	filename, size := info.BinaryName, info.BinaryByteSize
+	key, err := j.key(filename, info)
+	if err != nil {
+		return fmt.Errorf("key: %w", err)
 	}
 
-	out := outFile
+	dl := &download.Downloader{
+		Client:       client,
+		ModelPath:    info.ModelPath,
+		BinaryName:   filename,
+		Size:         size,
+		Model:        j.Model,
+		Region:       j.Region,
+		Version:      fota.NormalizeVersion(j.Version),
+		CRC32:        info.BinaryCRC,
+		Connections:  connections,
+		Limiter:      &limiter,
+		StallTimeout: stallTime,
+		MinSpeed:     minSpeed,
+		OnRestart: func(reason string) {
+			fmt.Fprintf(j.out, "Discarding existing download (%s), starting over.\n", reason)
+		},
+	}
+	if decryptLive {
+		dl.Key = key
+	}
+	if j.OutFile == "-" {
+		return j.stream(ctx, dl)
+	}
+
+	out := j.OutFile
 	if out == "" {
-		out = filepath.Join(outDir, filename)
+		out = filepath.Join(j.OutDir, filename)
 	} else if info, err := os.Stat(out); err == nil && info.IsDir() {
 		out = filepath.Join(out, filename)
 	}
 
-	fmt.Printf("Device: %s | CSC: %s\nFW: %s\nSize: %.3f GB\nPath: %s\n",
-		model, region, version, float64(size)/(1024*1024*1024), out)
+	j.printHeader(size, out)
 
 	decFile := strings.TrimSuffix(strings.TrimSuffix(out, ".enc4"), ".enc2")
-	if _, err := os.Stat(decFile); err == nil {
-		fmt.Println("Already decrypted!")
-		return
+	j.result = decFile
+	if exists(decFile) {
+		if validZip(decFile) {
+			fmt.Fprintln(j.out, "Already decrypted!")
+			return nil
+		}
+		fmt.Fprintf(j.out, "%s is not a valid zip, replacing it.\n", decFile)
+		if err := os.Remove(decFile); err != nil {
+			return err
+		}
 	}
 
-	var offset int64
-	if info, err := os.Stat(out); err == nil {
-		offset = info.Size()
-		if offset == size {
-			fmt.Println("Downloaded, decrypting...")
-			autoDecrypt(out, filename, effectiveIMEI)
-			return
+	// With -d the plaintext zip is written directly, and the encrypted
+	// file only with -k.
+	target := out
+	if decryptLive {
+		if keepEnc {
+			dl.EncryptedPath = out
 		}
-		fmt.Printf("Resuming from %.1f%%\n", float64(offset)/float64(size)*100)
+		target = decFile
+	}
+	if fwCache != nil {
+		if decryptLive {
+			// The cache stores the encrypted file, so keep it until cached.
+			dl.EncryptedPath = out
+		}
+		hit, unlock, err := j.fromCache(ctx, dl, key, out, decFile)
+		if err != nil || hit {
+			return err
+		}
+		defer unlock()
 	}
 
-	initDownload(client, filename)
-	resp, err := client.DownloadFile(path+filename, offset)
+	offset, err := dl.Status(target)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return err
 	}
-	defer resp.Body.Close()
 
-	if showMD5 {
-		if h := resp.Header.Get("Content-MD5"); h != "" {
-			if d, err := base64.StdEncoding.DecodeString(h); err == nil {
-				fmt.Printf("MD5: %x\n", d)
-			}
+	if !noSpace {
+		need, err := spaceNeeded(dl, target)
+		if err != nil {
+			return err
+		}
+		if err := download.CheckSpace(target, need); err != nil {
+			return err
 		}
 	}
 
-	flags := os.O_CREATE | os.O_WRONLY
+	if err := client.BinaryInit(ctx, filename); err != nil {
+		return err
+	}
+	if err := dl.CheckKey(ctx); err != nil {
+		return err
+	}
+
+	if offset == size {
+		fmt.Fprint(j.out, "Downloaded, verifying...")
+		if err := dl.ToFile(ctx, target); err != nil {
+			fmt.Fprintln(j.out)
+			return err
+		}
+		fmt.Fprintln(j.out, " OK.")
+		j.toCache(dl, out)
+		return j.autoDecrypt(ctx, out, key, info)
+	}
 	if offset > 0 {
-		flags |= os.O_APPEND
-	} else {
-		flags |= os.O_TRUNC
+		fmt.Fprintf(j.out, "Resuming from %.1f%%\n", float64(offset)/float64(size)*100)
 	}
 
-	fd, err := os.OpenFile(out, flags, 0644)
+	bar := j.watch(dl, offset)
+	err = dl.ToFile(ctx, target)
+	if bar != nil {
+		bar.Finish()
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		if ctx.Err() != nil {
+			fmt.Fprintln(j.out, "Partial download kept, run again to resume.")
+			return ctx.Err()
+		}
+		return err
 	}
+	fmt.Fprintln(j.out, "Done, checksums verified.")
+	j.reportStalls(dl)
+	j.toCache(dl, out)
+	return j.autoDecrypt(ctx, out, key, info)
+}
 
-	// Create async progress bar
-	bar := NewProgressBar(size)
-	bar.SetCurrent(offset)
-	bar.Start()
+// spaceNeeded returns the disk space the rest of the download of dl into
+// target takes, including the zip autoDecrypt writes next to the complete
+// encrypted file unless it is decrypted on the fly.
+func spaceNeeded(dl *download.Downloader, target string) (int64, error) {
+	need, err := dl.Remaining(target)
+	if err != nil {
+		return 0, err
+	}
+	if !decryptLive {
+		need += dl.Size
+	}
+	return need, nil
+}
+
+// stream downloads the firmware to stdout, decrypted with -d. Messages and
+// progress go to stderr.
+func (j *fwJob) stream(ctx context.Context, dl *download.Downloader) error {
+	j.printHeader(dl.Size, "stdout")
+	if connections > 1 {
+		fmt.Fprintln(j.out, "Streaming uses a single connection, ignoring -c.")
+	}
+	if err := dl.Client.BinaryInit(ctx, dl.BinaryName); err != nil {
+		return err
+	}
+	if err := dl.CheckKey(ctx); err != nil {
+		return err
+	}
+
+	bar := j.watch(dl, 0)
+	err := dl.ToWriter(ctx, os.Stdout)
+	if bar != nil {
+		bar.Finish()
+	}
+	if err != nil {
+		return err
+	}
+	j.result = "stdout"
+	fmt.Fprintln(j.out, "Done, checksums verified.")
+	j.reportStalls(dl)
+	return nil
+}
+
+func (j *fwJob) reportStalls(dl *download.Downloader) {
+	if n := dl.Stalls(); n > 0 {
+		fmt.Fprintf(j.out, "Recovered from %d stalled connection(s).\n", n)
+	}
+}
 
-	buf := make([]byte, 32768)
+func (j *fwJob) printHeader(size int64, path string) {
+	fmt.Fprintf(j.out, "Device: %s | CSC: %s\nFW: %s\nSize: %.3f GB\nPath: %s\n",
+		j.Model, j.Region, j.Version, float64(size)/(1024*1024*1024), path)
+}
 
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			fd.Write(buf[:n])
-			bar.Add(int64(n))
+// watch shows the MD5 of dl with -M, reports reconnects and, unless
+// disabled for the job, shows a progress bar starting at offset, which the
+// caller must finish.
+func (j *fwJob) watch(dl *download.Downloader, offset int64) *ProgressBar {
+	var md5Once sync.Once
+	dl.OnResponse = func(resp *http.Response) {
+		if !showMD5 {
+			return
 		}
-		if err == io.EOF {
-			break
+		md5Once.Do(func() {
+			if h := resp.Header.Get("Content-MD5"); h != "" {
+				if d, err := base64.StdEncoding.DecodeString(h); err == nil {
+					fmt.Fprintf(j.out, "MD5: %x\n", d)
+				}
+			}
+		})
+	}
+	var bar *ProgressBar
+	dl.OnReconnect = func(offset int64, err error) {
+		msg := fmt.Sprintf("Connection lost at %s (%v), resuming.", download.FormatSize(offset), err)
+		if errors.Is(err, download.ErrStalled) {
+			msg = fmt.Sprintf("Connection stalled at %s (%v), reconnecting.", download.FormatSize(offset), err)
 		}
-		if err != nil {
-			fd.Close()
-			bar.Finish()
-			fmt.Fprintf(os.Stderr, "\nError: %v\n", err)
-			os.Exit(1)
+		if bar != nil {
+			bar.Println(msg)
+		} else {
+			fmt.Fprintln(j.out, msg)
 		}
 	}
-	fd.Close()
-	bar.Finish()
-	fmt.Println("Done.")
-	autoDecrypt(out, filename, effectiveIMEI)
+	if !j.progress {
+		return nil
+	}
+	bar = NewProgressBar(j.out, dl.Size)
+	bar.SetCurrent(offset)
+	bar.Start()
+	dl.Progress = bar.Add
+	return bar
 }
 
-func parseIMEI() (string, error) {
-	if imei != "" {
-		switch len(imei) {
+// deviceID returns the IMEI or serial to send, generating a server-accepted
+// IMEI from a TAC.
+func (j *fwJob) deviceID(ctx context.Context) (string, error) {
+	if j.IMEI != "" {
+		switch len(j.IMEI) {
 		case 8:
-			return validateAndGenerateIMEI(imei, model, region)
+			fwVer, err := fotaClient.LatestVersion(ctx, j.Model, j.Region)
+			if err != nil {
+				return "", err
+			}
+			return imei.ValidateAndGenerate(ctx, j.IMEI, fwVer, j.Model, j.Region, j.reportIMEIAttempt, fusOpts...)
 		case 15:
-			return imei, nil
+			return j.IMEI, nil
 		default:
 			return "", fmt.Errorf("IMEI must be 8 or 15 digits")
 		}
 	}
-	if serial != "" {
-		return serial, nil
+	if j.Serial != "" {
+		return j.Serial, nil
 	}
 	return "", fmt.Errorf("IMEI (-i) or Serial (-s) required")
 }
 
-func getBinaryFile(client *FUSClient, fw, model, region, imei string) (path, filename string, size int64, err error) {
-	req := binaryInform(fw, model, region, imei, client.Nonce)
-	resp, err := client.MakeReq("NF_DownloadBinaryInform.do", req)
+func (j *fwJob) reportIMEIAttempt(attempt int, imei string, err error) {
 	if err != nil {
-		return "", "", 0, err
+		fmt.Fprintf(j.out, "Attempt %d: IMEI %s is invalid: %v\n", attempt, imei, err)
+		return
 	}
+	fmt.Fprintf(j.out, "Attempt %d: Valid IMEI Found: %s\n", attempt, imei)
+}
 
-	var fusResp FUSMsgResponse
-	if err := xml.Unmarshal([]byte(resp), &fusResp); err != nil {
-		return "", "", 0, err
+func (j *fwJob) autoDecrypt(ctx context.Context, out string, key []byte, info *fus.BinaryInfo) error {
+	if decryptLive {
+		if fwCache != nil && !keepEnc {
+			os.Remove(out)
+		}
+		return nil
+	}
+	dec := strings.TrimSuffix(strings.TrimSuffix(out, ".enc4"), ".enc2")
+	if _, err := os.Stat(dec); err == nil {
+		fmt.Fprintf(j.out, "%s exists\n", dec)
+		return nil
 	}
 
-	if fusResp.Body.Results.Status != 200 {
-		return "", "", 0, fmt.Errorf("status %d", fusResp.Body.Results.Status)
+	if err := checkFileKey(out, key); err != nil {
+		return err
+	}
+	j.removeStale(dec)
+	fmt.Fprint(j.out, "Decrypting...")
+	start := time.Now()
+	if err := firmware.DecryptFile(ctx, out, dec, key, workers, nil); err != nil {
+		fmt.Fprintln(j.out)
+		return fmt.Errorf("decrypt: %w", err)
+	}
+	fmt.Fprintf(j.out, " Done, %s.\n", decryptStats(info.BinaryByteSize, time.Since(start), workerCount()))
+	if !keepEnc {
+		os.Remove(out)
 	}
+	return nil
+}
 
-	filename = fusResp.Body.Put.BinaryName.Data
-	if filename == "" {
-		return "", "", 0, fmt.Errorf("no firmware found")
+// checkFileKey returns firmware.ErrWrongKey unless key decrypts the first
+// block of the encrypted file at path to the start of a zip.
+func checkFileKey(path string, key []byte) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	first := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(fd, first); err != nil {
+		return err
 	}
+	if !firmware.CheckKey(first, key) {
+		return firmware.ErrWrongKey
+	}
+	return nil
+}
 
-	return fusResp.Body.Put.ModelPath.Data, filename, fusResp.Body.Put.BinaryByteSize.Data, nil
+// workerCount returns the number of decryption workers used for a file.
+func workerCount() int {
+	if workers > 0 {
+		return workers
+	}
+	return runtime.GOMAXPROCS(0)
 }
 
-func initDownload(client *FUSClient, filename string) {
-	req := binaryInit(filename, client.Nonce)
-	client.MakeReq("NF_DownloadBinaryInitForMass.do", req)
+// decryptStats describes the throughput of decrypting size bytes.
+func decryptStats(size int64, elapsed time.Duration, workers int) string {
+	rate := float64(size) / max(elapsed.Seconds(), 0.001)
+	unit := "workers"
+	if workers == 1 {
+		unit = "worker"
+	}
+	return fmt.Sprintf("%s in %s (%s/s, %d %s)", download.FormatSize(size), elapsed.Round(time.Millisecond), download.FormatSize(int64(rate)), workers, unit)
 }
 
-func autoDecrypt(out, filename, effectiveIMEI string) {
-	dec := strings.TrimSuffix(strings.TrimSuffix(out, ".enc4"), ".enc2")
-	if _, err := os.Stat(dec); err == nil {
-		fmt.Printf("%s exists\n", dec)
-		return
+// key derives the key of filename from its BinaryInform reply.
+func (j *fwJob) key(filename string, info *fus.BinaryInfo) ([]byte, error) {
+	if firmware.FileVersion(filename) == 2 {
+		return firmware.V2Key(j.Version, j.Model, j.Region), nil
 	}
+	return firmware.V4Key(info.LatestFWVersion, info.LogicValueFactory)
+}
 
-	fmt.Print("Decrypting...")
-	var key []byte
-	var err error
-	if strings.HasSuffix(filename, ".enc2") {
-		key = getV2Key(version, model, region)
-	} else {
-		key, err = getV4Key(version, model, region, effectiveIMEI)
+func (j *fwJob) fetchV4Key(ctx context.Context, effectiveIMEI string) ([]byte, error) {
+	client, err := newFUSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return firmware.FetchV4Key(ctx, client, j.Version, j.Model, j.Region, effectiveIMEI)
+}
+
+func decrypt(ctx context.Context) error {
+	j := cliJob()
+
+	// "-" reads stdin or writes stdout.
+	var src io.Reader = os.Stdin
+	size := int64(-1)
+	if inFile != "-" {
+		f, err := os.Open(inFile)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Key error: %v\n", err)
-			return
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
 		}
+		src, size = f, info.Size()
 	}
 
-	if err := decryptFirmware(out, dec, key, false); err != nil {
-		fmt.Fprintf(os.Stderr, "Decrypt error: %v\n", err)
-		return
+	// The key is checked against the first block before any output is
+	// written, and picks the encryption version unless -V is given.
+	br := bufio.NewReaderSize(src, 64<<10)
+	first, err := br.Peek(aes.BlockSize)
+	if err == io.EOF {
+		return errors.New("input is too short to be encrypted firmware")
+	} else if err != nil {
+		return err
 	}
-	os.Remove(out)
-	fmt.Println(" Done.")
-}
-
-func decrypt() {
-	effectiveIMEI, err := parseIMEI()
+	src = br
+	versions := firmware.Versions(inFile)
+	if encVer != 0 {
+		versions = []int{encVer}
+	}
+	ver, key, err := firmware.SelectKey(first, versions, func(v int) ([]byte, error) {
+		if v == 2 {
+			return firmware.V2Key(version, model, region), nil
+		}
+		effectiveIMEI, err := j.deviceID(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return j.fetchV4Key(ctx, effectiveIMEI)
+	})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		return fmt.Errorf("key: %w", err)
+	}
+	if encVer == 0 {
+		fmt.Fprintf(j.out, "Encryption version %d detected.\n", ver)
+	}
+
+	if !noSpace && outFile != "-" && size >= 0 {
+		if err := download.CheckSpace(outFile, size); err != nil {
+			return err
+		}
 	}
 
-	var key []byte
-	if encVer == 2 {
-		key = getV2Key(version, model, region)
+	// Files are decrypted in parallel, streams sequentially.
+	var done int64
+	report := j.decryptProgress()
+	progress := func(n, total int64) {
+		done = n
+		report(n, total)
+	}
+	start, used := time.Now(), 1
+	switch {
+	case outFile == "-":
+		err = firmware.Decrypt(ctx, os.Stdout, src, key, size, progress)
+	case inFile == "-":
+		j.removeStale(outFile)
+		err = firmware.DecryptToFile(ctx, outFile, src, size, key, progress)
+	default:
+		j.removeStale(outFile)
+		used = workerCount()
+		err = firmware.DecryptFile(ctx, inFile, outFile, key, used, progress)
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		fmt.Fprintln(j.out, "\rDecrypting: 100.0%")
 	} else {
-		key, err = getV4Key(version, model, region, effectiveIMEI)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Key error: %v\n", err)
-			os.Exit(1)
+		fmt.Fprintf(j.out, "\rDecrypting: %s\n", download.FormatSize(done))
+	}
+	fmt.Fprintf(j.out, "Done, %s.\n", decryptStats(done, time.Since(start), used))
+	return nil
+}
+
+// decryptProgress returns a progress callback printing the share of total
+// decrypted, or the amount if the size of the input is unknown, at most
+// every 100ms as the progress bar is drawn.
+func (j *fwJob) decryptProgress() func(done, total int64) {
+	var last time.Time
+	return func(done, total int64) {
+		if time.Since(last) < 100*time.Millisecond {
+			return
+		}
+		last = time.Now()
+		if total < 0 {
+			fmt.Fprintf(j.out, "\rDecrypting: %s", download.FormatSize(done))
+		} else {
+			fmt.Fprintf(j.out, "\rDecrypting: %.1f%%", float64(done)/float64(total)*100)
 		}
 	}
+}
 
-	if err := decryptFirmware(inFile, outFile, key, true); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// validZip reports whether path opens as a zip archive, which a truncated
+// decryption output does not.
+func validZip(path string) bool {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return false
+	}
+	r.Close()
+	return true
+}
+
+// removeStale deletes the temporary output an interrupted decryption left
+// for path. A temporary file with download state is a resumable download
+// and kept.
+func (j *fwJob) removeStale(path string) {
+	tmp := download.TempPath(path)
+	if !exists(tmp) || exists(download.StatePath(path)) {
+		return
 	}
-	fmt.Println("Done.")
+	fmt.Fprintf(j.out, "Removing %s left by an interrupted run.\n", tmp)
+	os.Remove(tmp)
 }
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattchengg/susgo/cache"
+	"github.com/mattchengg/susgo/download"
+	"github.com/mattchengg/susgo/firmware"
+	"github.com/mattchengg/susgo/fota"
+	"github.com/mattchengg/susgo/fustest"
+)
+
+const (
+	testModel  = "SM-S928B"
+	testRegion = "EUX"
+	testIMEI   = "351234567871819"
+	testVer    = "S928BXXS4CYK8/S928BOXM4CYK8/S928BXXS4CYK8/S928BXXS4CYK8"
+)
+
+// startServer starts a fustest.Server with fws and points the global
+// clients at it for the duration of the test.
+func startServer(t *testing.T, fws ...fustest.Firmware) *fustest.Server {
+	t.Helper()
+	srv, err := fustest.NewServer(fws...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+
+	oldFOTA, oldFUS, oldConns := fotaClient, fusOpts, connections
+	t.Cleanup(func() { fotaClient, fusOpts, connections = oldFOTA, oldFUS, oldConns })
+	fotaClient = fota.NewClient(srv.FOTAOptions()...)
+	fusOpts = srv.FUSOptions()
+	connections = 1
+	return srv
+}
+
+func TestDownloadResumeDecrypt(t *testing.T) {
+	for _, enc := range []int{4, 2} {
+		srv := startServer(t, fustest.Firmware{Model: testModel, Region: testRegion, Version: testVer, EncVersion: enc})
+
+		// checkupdate
+		latest, err := fotaClient.LatestVersion(context.Background(), testModel, testRegion)
+		if err != nil || latest != testVer {
+			t.Fatalf("enc%d: LatestVersion = %q, %v; want %q", enc, latest, err, testVer)
+		}
+
+		dir := t.TempDir()
+		var out bytes.Buffer
+		job := &fwJob{Model: testModel, Region: testRegion, IMEI: testIMEI, OutDir: dir, out: &out}
+
+		// Cancel the download once part of the file has arrived.
+		srv.Throttle(64 << 10)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- job.download(ctx) }()
+		part := partialDownload(t, dir, done)
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Fatalf("enc%d: cancelled download = %v, want %v", enc, err, context.Canceled)
+		}
+		if _, err := os.Stat(part); err != nil {
+			t.Fatalf("enc%d: partial download not kept: %v", enc, err)
+		}
+		if _, err := os.Stat(download.StatePath(strings.TrimSuffix(part, ".part"))); err != nil {
+			t.Fatalf("enc%d: resume state not kept: %v", enc, err)
+		}
+
+		// Resume at full speed; the firmware is verified and decrypted.
+		srv.Throttle(0)
+		out.Reset()
+		if err := job.download(context.Background()); err != nil {
+			t.Fatalf("enc%d: resumed download: %v\n%s", enc, err, out.String())
+		}
+		if !strings.Contains(out.String(), "Resuming from") {
+			t.Errorf("enc%d: download did not resume:\n%s", enc, out.String())
+		}
+		got, err := os.ReadFile(job.result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, srv.Plaintext(testModel, testRegion, testVer)) {
+			t.Errorf("enc%d: decrypted firmware differs from the served zip", enc)
+		}
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != 1 {
+			t.Errorf("enc%d: %d files left in the output directory, want only the zip", enc, len(entries))
+		}
+	}
+}
+
+// partialDownload waits for the download in dir to write part of its
+// temporary file and returns its path.
+func partialDownload(t *testing.T, dir string, done <-chan error) string {
+	t.Helper()
+	for {
+		parts, _ := filepath.Glob(filepath.Join(dir, "*.part"))
+		if len(parts) == 1 {
+			if info, err := os.Stat(parts[0]); err == nil && info.Size() > 0 {
+				return parts[0]
+			}
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("download finished before it was cancelled: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestVerificationFailureSkipsDecrypt(t *testing.T) {
+	srv := startServer(t, fustest.Firmware{Model: testModel, Region: testRegion, Version: testVer})
+	c, err := newFUSClient(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.BinaryInform(context.Background(), testVer, testModel, testRegion, testIMEI)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A complete but corrupt download, as left by an earlier run.
+	dir := t.TempDir()
+	out := filepath.Join(dir, info.BinaryName)
+	data := bytes.Clone(srv.Ciphertext(testModel, testRegion, testVer))
+	data[len(data)/2] ^= 1
+	if err := os.WriteFile(download.TempPath(out), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	job := &fwJob{Model: testModel, Region: testRegion, IMEI: testIMEI, OutDir: dir, out: &log}
+	if err := job.download(context.Background()); !errors.Is(err, download.ErrIntegrity) {
+		t.Fatalf("download = %v, want %v", err, download.ErrIntegrity)
+	}
+	if _, err := os.Stat(download.TempPath(out)); err != nil {
+		t.Errorf("encrypted file not kept: %v", err)
+	}
+	for _, p := range []string{out, strings.TrimSuffix(out, ".enc4")} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s exists after failed verification", filepath.Base(p))
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"500000", 500000, false},
+		{"0", 0, false},
+		{"500K", 500 << 10, false},
+		{"500k", 500 << 10, false},
+		{"2M", 2 << 20, false},
+		{"1.5MB/s", 3 << 19, false},
+		{" 1G ", 1 << 30, false},
+		{"10KB", 10 << 10, false},
+		{"100B/s", 100, false},
+		{"", 0, true},
+		{"fast", 0, true},
+		{"-1M", 0, true},
+		{"1T", 0, true},
+		{"M", 0, true},
+		{"1KM", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRate(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("parseRate(%q) = %d, %v; want %d, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestSpaceNeeded(t *testing.T) {
+	defer func(old bool) { decryptLive = old }(decryptLive)
+	target := filepath.Join(t.TempDir(), "fw.zip.enc4")
+	tests := []struct {
+		live      bool
+		key       []byte
+		encrypted string
+		want      int64
+	}{
+		// The encrypted file, then the zip decrypted from it.
+		{false, nil, "", 2000},
+		// Only the zip, or the zip and the encrypted copy kept with -k.
+		{true, make([]byte, 16), "", 1000},
+		{true, make([]byte, 16), target, 2000},
+	}
+	for _, tt := range tests {
+		decryptLive = tt.live
+		dl := &download.Downloader{Size: 1000, Key: tt.key, EncryptedPath: tt.encrypted}
+		if got, err := spaceNeeded(dl, target); err != nil || got != tt.want {
+			t.Errorf("live %v, encrypted copy %q: spaceNeeded = %d, %v; want %d", tt.live, tt.encrypted, got, err, tt.want)
+		}
+	}
+
+}
+
+func TestCacheHit(t *testing.T) {
+	srv := startServer(t, fustest.Firmware{Model: testModel, Region: testRegion, Version: testVer})
+	c, err := cache.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(old *cache.Cache, keep bool) { fwCache, keepEnc = old, keep }(fwCache, keepEnc)
+	fwCache = c
+
+	for i, keep := range []bool{false, false, true} {
+		keepEnc = keep
+		var log bytes.Buffer
+		dir := t.TempDir()
+		job := &fwJob{Model: testModel, Region: testRegion, IMEI: testIMEI, OutDir: dir, out: &log}
+		if err := job.download(context.Background()); err != nil {
+			t.Fatalf("download %d: %v\n%s", i, err, log.String())
+		}
+		if hit := strings.Contains(log.String(), "Found in cache"); hit != (i > 0) {
+			t.Errorf("download %d: cache hit %v:\n%s", i, hit, log.String())
+		}
+		got, err := os.ReadFile(job.result)
+		if err != nil || !bytes.Equal(got, srv.Plaintext(testModel, testRegion, testVer)) {
+			t.Errorf("download %d: decrypted firmware differs from the served zip: %v", i, err)
+		}
+
+		// Only the zip is left, and the encrypted file with -k, which is
+		// a writable copy of the read-only cache object.
+		entries, _ := os.ReadDir(dir)
+		if want := map[bool]int{false: 1, true: 2}[keep]; len(entries) != want {
+			t.Errorf("download %d: %d files in the output directory, want %d", i, len(entries), want)
+		}
+		if keep {
+			enc := job.result + ".enc4"
+			info, err := os.Stat(enc)
+			if err != nil || info.Mode().Perm()&0200 == 0 {
+				t.Errorf("download %d: encrypted file not kept writable: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestDecryptKey(t *testing.T) {
+	defer func(m, r, i, v, in, out string, ev int) {
+		model, region, imeiArg, version, inFile, outFile, encVer = m, r, i, v, in, out, ev
+	}(model, region, imeiArg, version, inFile, outFile, encVer)
+	model, region, imeiArg, version = testModel, testRegion, testIMEI, testVer
+
+	tests := []struct {
+		enc    int    // encryption of the firmware
+		name   string // of the encrypted file
+		encVer int    // -V
+		ok     bool
+	}{
+		{4, "fw.zip.enc4", 0, true},
+		{2, "fw.zip.enc2", 0, true},
+		// Detected whatever the file is called.
+		{2, "fw.zip.enc4", 0, true},
+		{4, "fw.bin", 0, true},
+		{4, "fw.zip.enc4", 4, true},
+		// A wrong -V fails before anything is written.
+		{4, "fw.zip.enc4", 2, false},
+		{2, "fw.zip.enc2", 4, false},
+	}
+	for _, tt := range tests {
+		srv := startServer(t, fustest.Firmware{Model: testModel, Region: testRegion, Version: testVer, EncVersion: tt.enc})
+		dir := t.TempDir()
+		inFile = filepath.Join(dir, tt.name)
+		outFile = filepath.Join(dir, "fw.zip")
+		encVer = tt.encVer
+		if err := os.WriteFile(inFile, srv.Ciphertext(testModel, testRegion, testVer), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		err := decrypt(context.Background())
+		if !tt.ok {
+			if !errors.Is(err, firmware.ErrWrongKey) {
+				t.Errorf("enc%d %s -V %d: decrypt = %v, want %v", tt.enc, tt.name, tt.encVer, err, firmware.ErrWrongKey)
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+				t.Errorf("enc%d %s -V %d: %d files left, want only the input", tt.enc, tt.name, tt.encVer, len(entries))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("enc%d %s -V %d: %v", tt.enc, tt.name, tt.encVer, err)
+			continue
+		}
+		got, err := os.ReadFile(outFile)
+		if err != nil || !bytes.Equal(got, srv.Plaintext(testModel, testRegion, testVer)) {
+			t.Errorf("enc%d %s -V %d: decrypted firmware differs from the served zip: %v", tt.enc, tt.name, tt.encVer, err)
+		}
+	}
+}
+
+// captureOutput runs fn with stdin reading in, and returns what it wrote to
+// stdout and stderr, and its error.
+func captureOutput(t *testing.T, in []byte, fn func() error) (stdout, stderr string, err error) {
+	t.Helper()
+	dir := t.TempDir()
+	stdin := filepath.Join(dir, "stdin")
+	if err := os.WriteFile(stdin, in, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var files [3]*os.File
+	for i, name := range []string{stdin, filepath.Join(dir, "stdout"), filepath.Join(dir, "stderr")} {
+		fd, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fd.Close()
+		files[i] = fd
+	}
+
+	oldIn, oldOut, oldErr := os.Stdin, os.Stdout, os.Stderr
+	os.Stdin, os.Stdout, os.Stderr = files[0], files[1], files[2]
+	err = fn()
+	os.Stdin, os.Stdout, os.Stderr = oldIn, oldOut, oldErr
+
+	out, rerr := os.ReadFile(files[1].Name())
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	errOut, rerr := os.ReadFile(files[2].Name())
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+	return string(out), string(errOut), err
+}
+
+func TestStreamToStdout(t *testing.T) {
+	srv := startServer(t, fustest.Firmware{Model: testModel, Region: testRegion, Version: testVer})
+	defer func(m, r, i, v, in, out string, live bool) {
+		model, region, imeiArg, version, inFile, outFile, decryptLive = m, r, i, v, in, out, live
+	}(model, region, imeiArg, version, inFile, outFile, decryptLive)
+	model, region, imeiArg, version, outFile = testModel, testRegion, testIMEI, testVer, "-"
+	enc, plain := srv.Ciphertext(testModel, testRegion, testVer), srv.Plaintext(testModel, testRegion, testVer)
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		live   bool
+		in     []byte
+		run    func() error
+		want   []byte
+		status string
+	}{
+		{"download -o -", false, nil, func() error { return downloadFirmware(ctx) }, enc, "Done, checksums verified."},
+		{"download -d -o -", true, nil, func() error { return downloadFirmware(ctx) }, plain, "Done, checksums verified."},
+		{"decrypt -I - -o -", false, enc, func() error { inFile = "-"; return decrypt(ctx) }, plain, "Decrypting: "},
+	}
+	for _, tt := range tests {
+		decryptLive = tt.live
+		stdout, stderr, err := captureOutput(t, tt.in, tt.run)
+		if err != nil {
+			t.Errorf("%s: %v\n%s", tt.name, err, stderr)
+			continue
+		}
+		if stdout != string(tt.want) {
+			t.Errorf("%s: stdout holds %d bytes differing from the %d of the firmware", tt.name, len(stdout), len(tt.want))
+		}
+		if !strings.Contains(stderr, tt.status) {
+			t.Errorf("%s: stderr lacks %q:\n%s", tt.name, tt.status, stderr)
+		}
+	}
+}
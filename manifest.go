@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// manifest lists the firmware the batch command downloads. It is read from
+// JSON or from the block-style subset of YAML handled by parseYAML:
+//
+//	concurrency: 2
+//	retries: 1
+//	output: firmware
+//	jobs:
+//	  - model: SM-S928B
+//	    region: EUX
+//	    imei: "35123456"
+//	    version: latest
+//	  - model: SM-A505F
+//	    region: XAR
+//	    serial: R58M12345AB
+//	    output: firmware/a50
+//
+// A manifest may also be just the list of jobs.
+type manifest struct {
+	Concurrency int
+	Retries     int
+	Output      string
+	Jobs        []*fwJob
+}
+
+func loadManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&doc)
+	} else {
+		doc, err = parseYAML(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	m, err := decodeManifest(doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// decodeManifest converts a generic JSON or YAML document into a manifest.
+func decodeManifest(doc any) (*manifest, error) {
+	m := &manifest{Concurrency: -1, Retries: -1}
+	var jobs []any
+	switch doc := doc.(type) {
+	case []any:
+		jobs = doc
+	case map[string]any:
+		for key, v := range doc {
+			var err error
+			switch key {
+			case "concurrency":
+				m.Concurrency, err = scalarInt(v)
+			case "retries":
+				m.Retries, err = scalarInt(v)
+			case "output":
+				m.Output, err = scalarString(v)
+			case "jobs":
+				var ok bool
+				if jobs, ok = v.([]any); !ok && v != nil {
+					err = fmt.Errorf("not a list")
+				}
+			default:
+				err = fmt.Errorf("unknown key")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("manifest must be a list of jobs or a mapping with jobs")
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no jobs")
+	}
+
+	for i, v := range jobs {
+		j, err := decodeJob(v)
+		if err != nil {
+			return nil, fmt.Errorf("job %d: %w", i+1, err)
+		}
+		if j.OutDir == "" {
+			j.OutDir = m.Output
+		}
+		if j.OutDir == "" {
+			j.OutDir = "."
+		}
+		m.Jobs = append(m.Jobs, j)
+	}
+	return m, nil
+}
+
+func decodeJob(v any) (*fwJob, error) {
+	fields, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("not a mapping")
+	}
+	j := &fwJob{}
+	for key, v := range fields {
+		var dst *string
+		switch key {
+		case "model":
+			dst = &j.Model
+		case "region":
+			dst = &j.Region
+		case "imei":
+			dst = &j.IMEI
+		case "serial":
+			dst = &j.Serial
+		case "version":
+			dst = &j.Version
+		case "output":
+			dst = &j.OutDir
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+		s, err := scalarString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		*dst = s
+	}
+	if strings.EqualFold(j.Version, "latest") {
+		j.Version = ""
+	}
+	switch {
+	case j.Model == "" || j.Region == "":
+		return nil, fmt.Errorf("model and region are required")
+	case j.IMEI == "" && j.Serial == "":
+		return nil, fmt.Errorf("imei or serial is required")
+	}
+	return j, nil
+}
+
+func scalarString(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	}
+	return "", fmt.Errorf("not a string")
+}
+
+func scalarInt(v any) (int, error) {
+	s, err := scalarString(v)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("not an integer")
+	}
+	return n, nil
+}
+
+// yamlLine is a non-blank line of a YAML document without its comment.
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// parseYAML parses the block-style YAML subset used by manifests: nested
+// mappings and sequences, plain, single- and double-quoted scalars, and
+// comments. Flow collections, anchors and multi-line scalars are not
+// supported. Scalars are returned as strings, null and ~ as nil.
+func parseYAML(data []byte) (any, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(string(data), "\n") {
+		text := strings.TrimRight(stripComment(strings.TrimRight(raw, "\r")), " \t")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].num)
+	}
+	return v, nil
+}
+
+// stripComment removes a # comment that is not inside quotes.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return s[:i]
+		}
+	}
+	return s
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func isSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) block(indent int) (any, error) {
+	if isSeqItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+// nested parses the block below a "key:" or "-" line at indent, if any.
+// A sequence may sit at the same indent as the key that owns it.
+func (p *yamlParser) nested(indent int, allowSeq bool) (any, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent || allowSeq && next.indent == indent && isSeqItem(next.text) {
+		return p.block(next.indent)
+	}
+	return nil, nil
+}
+
+func (p *yamlParser) sequence(indent int) ([]any, error) {
+	var out []any
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent || l.indent == indent && !isSeqItem(l.text) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		after := l.text[1:]
+		rest := strings.TrimLeft(after, " ")
+		switch {
+		case rest == "":
+			p.pos++
+			v, err := p.nested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		case isMappingLine(rest):
+			// "- key: value" opens a mapping whose keys line up with key.
+			col := l.indent + 1 + len(after) - len(rest)
+			p.lines[p.pos] = yamlLine{num: l.num, indent: col, text: rest}
+			v, err := p.mapping(col)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		default:
+			v, err := parseScalar(rest, l.num)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+			p.pos++
+		}
+	}
+	return out, nil
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]any, error) {
+	out := map[string]any{}
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.num)
+		}
+		key, value, ok := splitKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", l.num)
+		}
+		if _, dup := out[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", l.num, key)
+		}
+		p.pos++
+		var v any
+		var err error
+		if value == "" {
+			v, err = p.nested(indent, true)
+		} else {
+			v, err = parseScalar(value, l.num)
+		}
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+func isMappingLine(text string) bool {
+	_, _, ok := splitKey(text)
+	return ok
+}
+
+// splitKey splits "key: value" or "key:" at the first colon that ends the
+// key. The key may be quoted, but not a flow collection, anchor or tag.
+func splitKey(text string) (key, value string, ok bool) {
+	if strings.ContainsRune(yamlIndicators, rune(text[0])) {
+		return "", "", false
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		end := strings.IndexByte(text[1:], text[0])
+		if end < 0 {
+			return "", "", false
+		}
+		key, rest := text[1:end+1], text[end+2:]
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", false
+		}
+		return key, strings.TrimSpace(rest[1:]), true
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i == len(text)-1 || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), i > 0
+		}
+	}
+	return "", "", false
+}
+
+// yamlIndicators are the characters that start the unsupported flow
+// collections, anchors, aliases, tags and block scalars.
+const yamlIndicators = "[{&*|>!"
+
+func parseScalar(s string, num int) (any, error) {
+	switch {
+	case s == "~" || s == "null":
+		return nil, nil
+	case s[0] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid double-quoted string", num)
+		}
+		return v, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("line %d: invalid single-quoted string", num)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.ContainsRune(yamlIndicators, rune(s[0])):
+		return nil, fmt.Errorf("line %d: flow collections, anchors, tags and block scalars are not supported", num)
+	}
+	return s, nil
+}
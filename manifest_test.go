@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want any
+	}{
+		{
+			"sequence at key indentation",
+			"jobs:\n- model: A\n  region: B\n- model: C\nretries: 1\n",
+			map[string]any{"jobs": []any{map[string]any{"model": "A", "region": "B"}, map[string]any{"model": "C"}}, "retries": "1"},
+		},
+		{
+			"indented sequence",
+			"jobs:\n  - model: A\n    region: B\n  - model: C\n",
+			map[string]any{"jobs": []any{map[string]any{"model": "A", "region": "B"}, map[string]any{"model": "C"}}},
+		},
+		{
+			"top-level sequence",
+			"- model: A\n-   model: B\n    region: C\n",
+			[]any{map[string]any{"model": "A"}, map[string]any{"model": "B", "region": "C"}},
+		},
+		{
+			"item on its own line",
+			"-\n  model: A\n- \n",
+			[]any{map[string]any{"model": "A"}, nil},
+		},
+		{
+			"scalar sequence",
+			"- a\n- 'b'\n- \"c\"\n",
+			[]any{"a", "b", "c"},
+		},
+		{
+			"quoted keys and values",
+			"\"model\": \"SM-S928B\"\n'region': 'E''U X'\nimei: \"35123456\"\nversion: \"a # b\"\noutput: 'x: y'\nserial: \"tab\\there\"\n",
+			map[string]any{"model": "SM-S928B", "region": "E'U X", "imei": "35123456", "version": "a # b", "output": "x: y", "serial": "tab\there"},
+		},
+		{
+			"inline comments",
+			"# manifest\nmodel: SM-S928B # flagship\noutput: dir#1\njobs: # none yet\n",
+			map[string]any{"model": "SM-S928B", "output": "dir#1", "jobs": nil},
+		},
+		{
+			"blank and indented lines",
+			"---\n\nmodel: A\n   \n\t\n  # indented comment\nregion: B\r\n\n",
+			map[string]any{"model": "A", "region": "B"},
+		},
+		{
+			"nulls and colons in values",
+			"a: ~\nb: null\nc:\nd: http://host:80/x\ne: 12:30\n",
+			map[string]any{"a": nil, "b": nil, "c": nil, "d": "http://host:80/x", "e": "12:30"},
+		},
+		{
+			"indented document",
+			"  model: A\n  region: B\n",
+			map[string]any{"model": "A", "region": "B"},
+		},
+		{"empty", "\n# nothing\n", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseYAML([]byte(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseYAML = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"tab indentation", "jobs:\n\t- model: A\n", "line 2: tabs are not allowed"},
+		{"over-indented key", "model: A\n   region: B\n", "line 2: unexpected indentation"},
+		{"under-indented key", "jobs:\n  - model: A\n     region: B\n", "line 3: unexpected indentation"},
+		{"over-indented item", "- a\n  - b\n", "line 2: unexpected indentation"},
+		{"dedent past the document", "  model: A\nregion: B\n", "line 2: unexpected indentation"},
+		{"missing colon", "model: A\nregion B\n", "line 2: expected key: value"},
+		{"empty key", ": A\n", "line 1: expected key: value"},
+		{"duplicate key", "model: A\nregion: B\nmodel: C\n", `line 3: duplicate key "model"`},
+		{"duplicate key in item", "- model: A\n  model: B\n", `line 2: duplicate key "model"`},
+		{"unterminated double quote", "model: \"A\n", "line 1: invalid double-quoted string"},
+		{"unterminated single quote", "\n\nmodel: 'A\n", "line 3: invalid single-quoted string"},
+		{"unterminated quoted key", "\"model: A\n", "line 1: expected key: value"},
+		{"flow sequence", "jobs: [a, b]\n", "line 1: flow collections"},
+		{"flow mapping", "- {model: A}\n", "line 1: flow collections"},
+		{"anchor", "model: &m A\n", "line 1: flow collections, anchors"},
+		{"block scalar", "model: |\n  A\n", "line 1: flow collections, anchors, tags and block scalars"},
+	}
+	for _, tt := range tests {
+		_, err := parseYAML([]byte(tt.in))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: parseYAML error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestLoadManifest(t *testing.T) {
+	yaml := `concurrency: 2
+output: firmware
+jobs:
+- model: SM-S928B
+  region: EUX
+  imei: "35123456"
+  version: latest
+- model: SM-A505F
+  region: XAR
+  serial: R58M12345AB
+  output: firmware/a50
+`
+	json := `{"concurrency": 2, "output": "firmware", "jobs": [
+	{"model": "SM-S928B", "region": "EUX", "imei": "35123456", "version": "latest"},
+	{"model": "SM-A505F", "region": "XAR", "serial": "R58M12345AB", "output": "firmware/a50"}
+]}`
+	want := &manifest{Concurrency: 2, Retries: -1, Output: "firmware", Jobs: []*fwJob{
+		{Model: "SM-S928B", Region: "EUX", IMEI: "35123456", OutDir: "firmware"},
+		{Model: "SM-A505F", Region: "XAR", Serial: "R58M12345AB", OutDir: "firmware/a50"},
+	}}
+	dir := t.TempDir()
+	for name, data := range map[string]string{"jobs.yaml": yaml, "jobs.json": json} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		m, err := loadManifest(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !reflect.DeepEqual(m, want) {
+			t.Errorf("%s: loadManifest = %+v, want %+v", name, m, want)
+		}
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"model: A\n  region: B\n", "jobs.yaml: line 2: unexpected indentation"},
+		{"jobs:\n- model: A\n  region: B\n", "job 1: imei or serial is required"},
+		{"- model: A\n  region: B\n  imei: '1'\n  colour: red\n", `job 1: unknown key "colour"`},
+		{"jobs: []\n", "line 1: flow collections"},
+		{"jobs:\n", "no jobs"},
+		{"retries: many\njobs:\n- model: A\n", "retries: not an integer"},
+		{"jobs: x\n", "jobs: not a list"},
+		{"just a string\n", "line 1: expected key: value"},
+	}
+	path := filepath.Join(t.TempDir(), "jobs.yaml")
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(tt.in), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := loadManifest(path)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("loadManifest(%q) error = %v, want %q", tt.in, err, tt.want)
+		}
+	}
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/mattchengg/susgo/download"
 )
 
 type ProgressBar struct {
+	w          io.Writer
 	total      int64
 	current    int64
 	width      int
@@ -17,8 +21,9 @@ type ProgressBar struct {
 	done       chan struct{}
 }
 
-func NewProgressBar(total int64) *ProgressBar {
+func NewProgressBar(w io.Writer, total int64) *ProgressBar {
 	return &ProgressBar{
+		w:         w,
 		total:     total,
 		width:     40,
 		startTime: time.Now(),
@@ -42,10 +47,17 @@ func (p *ProgressBar) SetCurrent(n int64) {
 	p.mu.Unlock()
 }
 
+// Println prints a message on its own line below the bar, which continues
+// on the next line.
+func (p *ProgressBar) Println(msg string) {
+	p.printBar()
+	fmt.Fprintf(p.w, "\n%s\n", msg)
+}
+
 func (p *ProgressBar) Finish() {
 	close(p.done)
 	p.printBar()
-	fmt.Println()
+	fmt.Fprintln(p.w)
 }
 
 func (p *ProgressBar) render() {
@@ -100,25 +112,12 @@ func (p *ProgressBar) printBar() {
 		eta = "--"
 	}
 
-	fmt.Printf("\r[%s] %5.1f%% %s/%s %s/s ETA %s  ",
+	fmt.Fprintf(p.w, "\r[%s] %5.1f%% %s/%s %s/s ETA %s  ",
 		bar,
 		pct*100,
-		formatSize(current),
-		formatSize(total),
-		formatSize(int64(speed)),
+		download.FormatSize(current),
+		download.FormatSize(total),
+		download.FormatSize(int64(speed)),
 		eta,
 	)
 }
-
-func formatSize(b int64) string {
-	const unit = 1024
-	if b < unit {
-		return fmt.Sprintf("%dB", b)
-	}
-	div, exp := int64(unit), 0
-	for n := b / unit; n >= unit; n /= unit {
-		div *= unit
-		exp++
-	}
-	return fmt.Sprintf("%.1f%cB", float64(b)/float64(div), "KMGTPE"[exp])
-}
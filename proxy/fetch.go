@@ -0,0 +1,345 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mattchengg/susgo/cache"
+	"github.com/mattchengg/susgo/download"
+	"github.com/mattchengg/susgo/fus"
+)
+
+// fetch is an upstream download in progress. Clients read the bytes
+// downloaded so far from its temporary file and wait for more.
+type fetch struct {
+	size int64
+
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced whenever the fields change
+	file    *os.File      // the temporary file, once created
+	avail   int64         // bytes of file written
+	md5     string        // Content-MD5 of the whole file, from upstream
+	done    bool
+	err     error
+	readers int
+}
+
+// startFetch returns the upstream download of rec, starting it unless it is
+// already running.
+func (s *Server) startFetch(rec *informRecord) (*fetch, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f := s.fetches[rec.file()]; f != nil {
+		return f, nil
+	}
+	imei := s.imeis[rec.key()]
+	if imei == "" {
+		return nil, errNoIMEI
+	}
+	f := &fetch{size: rec.Info.BinaryByteSize, changed: make(chan struct{})}
+	s.fetches[rec.file()] = f
+	go func() {
+		err := s.runFetch(f, rec, imei)
+		if err != nil {
+			s.Log.Warn("upstream download failed", "file", rec.Info.BinaryName, "err", err)
+		}
+		s.mu.Lock()
+		delete(s.fetches, rec.file())
+		s.mu.Unlock()
+		f.update(func() { f.done, f.err = true, err })
+	}()
+	return f, nil
+}
+
+// runFetch downloads rec from upstream into dir/partial, resuming an earlier
+// attempt, and moves the verified file into the cache. Like susgo with
+// -cache-dir, it holds the lock of the firmware meanwhile, and if another
+// process sharing the directory has cached it in the meantime, it is done.
+func (s *Server) runFetch(f *fetch, rec *informRecord, imei string) error {
+	ctx := s.ctx
+	unlock, err := s.cache.Lock(ctx, rec.key(), func() {
+		s.Log.Info("waiting for another download of the firmware to the cache", "file", rec.Info.BinaryName)
+	})
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if e, err := s.cache.Lookup(rec.key()); err != nil || e != nil && e.BinaryName == rec.Info.BinaryName {
+		return err
+	}
+
+	c, err := fus.NewClient(ctx, s.FUS...)
+	if err != nil {
+		return err
+	}
+	info, err := c.BinaryInform(ctx, rec.Version, rec.Model, rec.Region, imei)
+	if err != nil {
+		return err
+	}
+	if info.BinaryName != rec.Info.BinaryName || info.BinaryByteSize != rec.Info.BinaryByteSize {
+		return fmt.Errorf("upstream now serves %s for %s", info.BinaryName, rec.key())
+	}
+	if err := c.BinaryInit(ctx, info.BinaryName); err != nil {
+		return err
+	}
+
+	dl := &download.Downloader{
+		Client:       c,
+		ModelPath:    info.ModelPath,
+		BinaryName:   info.BinaryName,
+		Size:         info.BinaryByteSize,
+		Model:        rec.Model,
+		Region:       rec.Region,
+		Version:      rec.Version,
+		CRC32:        info.BinaryCRC,
+		Limiter:      s.Limiter,
+		StallTimeout: s.StallTimeout,
+		MinSpeed:     s.MinSpeed,
+		Progress: func(n int64) {
+			f.update(func() { f.avail += n })
+		},
+		OnReconnect: func(offset int64, err error) {
+			s.Log.Warn("upstream connection lost, resuming", "file", info.BinaryName, "offset", offset, "err", err)
+		},
+	}
+	// The MD5 of the whole file is passed on once upstream has announced
+	// it; see Downloader.ContentMD5.
+	dl.OnResponse = func(*http.Response) {
+		if sum := dl.ContentMD5(); sum != nil {
+			f.update(func() { f.md5 = base64.StdEncoding.EncodeToString(sum) })
+		}
+	}
+	path := filepath.Join(s.dir, "partial", info.BinaryName)
+
+	// A file completed by an earlier run that stopped before caching it.
+	if _, err := os.Stat(path); err == nil {
+		if err := dl.Verify(ctx, path); err == nil {
+			return s.store(dl, rec, path)
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	// Start over, rather than let ToFile replace the file clients read, if
+	// the partial file cannot be resumed.
+	offset, err := dl.Status(path)
+	if err != nil {
+		return err
+	}
+	if offset == 0 {
+		for _, p := range []string{download.TempPath(path), download.StatePath(path)} {
+			if err := os.Remove(p); err != nil && !isNotExist(err) {
+				return err
+			}
+		}
+	}
+	fd, err := os.OpenFile(download.TempPath(path), os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	f.update(func() { f.file, f.avail = fd, offset })
+	s.Log.Info("downloading from upstream", "file", info.BinaryName, "offset", offset)
+
+	if err := dl.ToFile(ctx, path); err != nil {
+		return err
+	}
+	return s.store(dl, rec, path)
+}
+
+// store moves the file at path, verified by dl, into the cache.
+func (s *Server) store(dl *download.Downloader, rec *informRecord, path string) error {
+	sum := dl.Sum()
+	if sum.MD5 == nil {
+		return fmt.Errorf("%s: no MD5 computed", dl.BinaryName)
+	}
+	e := &cache.Entry{
+		Model:      rec.Model,
+		Region:     rec.Region,
+		Version:    rec.Version,
+		BinaryName: dl.BinaryName,
+		Size:       dl.Size,
+		MD5:        hex.EncodeToString(sum.MD5),
+		CRC32:      sum.CRC32,
+	}
+	if err := s.cache.Put(path, e); err != nil {
+		return err
+	}
+	s.Log.Info("cached", "file", dl.BinaryName, "path", e.Path)
+	return os.Remove(path)
+}
+
+// update changes the fields of f in fn and wakes up waiting readers.
+func (f *fetch) update(fn func()) {
+	f.mu.Lock()
+	fn()
+	close(f.changed)
+	f.changed = make(chan struct{})
+	if f.done && f.readers == 0 && f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.mu.Unlock()
+}
+
+// acquire waits for the temporary file and registers a reader of it.
+func (f *fetch) acquire(done <-chan struct{}) (*os.File, error) {
+	for {
+		f.mu.Lock()
+		fd, err, finished, changed := f.file, f.err, f.done, f.changed
+		if fd != nil && !finished {
+			f.readers++
+		}
+		f.mu.Unlock()
+		switch {
+		case err != nil:
+			return nil, err
+		case finished:
+			return nil, errFetchDone
+		case fd != nil:
+			return fd, nil
+		}
+		select {
+		case <-done:
+			return nil, io.ErrUnexpectedEOF
+		case <-changed:
+		}
+	}
+}
+
+func (f *fetch) release() {
+	f.update(func() { f.readers-- })
+}
+
+// wait returns once more than pos bytes are available or the download has
+// ended, with the number of bytes available.
+func (f *fetch) wait(done <-chan struct{}, pos int64) (int64, error) {
+	for {
+		f.mu.Lock()
+		avail, finished, err, changed := f.avail, f.done, f.err, f.changed
+		f.mu.Unlock()
+		switch {
+		case avail > pos:
+			return avail, nil
+		case err != nil:
+			return 0, err
+		case finished:
+			return 0, io.ErrUnexpectedEOF
+		}
+		select {
+		case <-done:
+			return 0, io.ErrUnexpectedEOF
+		case <-changed:
+		}
+	}
+}
+
+// errFetchDone means the download finished before a client could join it;
+// the file is then served from the cache.
+var errFetchDone = errors.New("download finished")
+
+// serve sends the requested range of the file while it downloads.
+func (f *fetch) serve(w http.ResponseWriter, r *http.Request) {
+	fd, err := f.acquire(r.Context().Done())
+	if err == errFetchDone {
+		// Retry, now that the file is in the cache.
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return
+	}
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer f.release()
+
+	start, end, ok := parseRange(r.Header.Get("Range"), f.size)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", f.size))
+		http.Error(w, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	f.mu.Lock()
+	sum := f.md5
+	f.mu.Unlock()
+	if sum != "" {
+		w.Header().Set("Content-MD5", sum)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+	if r.Header.Get("Range") != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, f.size))
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	for pos := start; pos < end; {
+		avail, err := f.wait(r.Context().Done(), pos)
+		if err != nil {
+			// Headers are sent; abort so the client sees a short body.
+			panic(http.ErrAbortHandler)
+		}
+		n := min(avail, end) - pos
+		if _, err := io.Copy(w, io.NewSectionReader(fd, pos, n)); err != nil {
+			return
+		}
+		pos += n
+		if fl, ok := w.(http.Flusher); ok {
+			fl.Flush()
+		}
+	}
+}
+
+// parseRange parses a single-range Range header, returning the half-open
+// byte range [start, end) of a file of size bytes. No header selects the
+// whole file.
+func parseRange(h string, size int64) (start, end int64, ok bool) {
+	if h == "" {
+		return 0, size, true
+	}
+	spec, found := strings.CutPrefix(h, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, 0, false
+	}
+	var err error
+	switch {
+	case first == "":
+		// A suffix range: the last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size, true
+	case last == "":
+		end = size
+	default:
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil {
+			return 0, 0, false
+		}
+		end = min(end+1, size)
+	}
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil || start >= size || start >= end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+func hexToBase64(s string) (string, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
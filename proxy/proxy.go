@@ -0,0 +1,358 @@
+// Package proxy implements a caching stand-in for the FUS and FOTA servers.
+// susgo instances pointed at it with -fus-url, -download-url and -fota-url
+// talk to it as they would to Samsung: it answers BinaryInform from replies
+// it fetched upstream once, downloads every firmware file from upstream only
+// once into a cache.Cache, and serves it from there, with Range support and
+// to any number of clients while the upstream download is still running.
+//
+// The proxy hands out nonces but does not check its clients' signatures.
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattchengg/susgo/cache"
+	"github.com/mattchengg/susgo/download"
+	"github.com/mattchengg/susgo/fota"
+	"github.com/mattchengg/susgo/fus"
+	"github.com/mattchengg/susgo/internal/fusmsg"
+)
+
+// DefaultVersionTTL is how long a version.xml reply is served from memory.
+const DefaultVersionTTL = 10 * time.Minute
+
+// Server is a caching FUS/FOTA server. Create it with New and set the
+// upstream fields before calling Serve.
+type Server struct {
+	// FUS configures the clients that talk to the upstream FUS server.
+	FUS []fus.Option
+	// FOTAURL is the upstream FOTA base URL, fetched with HTTPClient.
+	FOTAURL    string
+	HTTPClient *http.Client
+	// VersionTTL is how long version.xml replies are reused; zero means
+	// DefaultVersionTTL.
+	VersionTTL time.Duration
+	// Limiter, if set, caps the upstream download throughput.
+	Limiter *download.Limiter
+	// StallTimeout and MinSpeed configure the stall detection of upstream
+	// downloads, as in download.Downloader.
+	StallTimeout time.Duration
+	MinSpeed     int64
+	Log          *slog.Logger
+
+	dir   string
+	cache *cache.Cache
+	ctx   context.Context // of Serve, for upstream downloads
+
+	mu       sync.Mutex
+	informs  map[cache.Key]*informRecord
+	files    map[string]*informRecord // by MODEL_PATH + BINARY_NAME
+	imeis    map[cache.Key]string     // last IMEI or serial seen, not stored
+	fetches  map[string]*fetch        // by MODEL_PATH + BINARY_NAME
+	versions map[string]*versionReply // by path
+}
+
+// informRecord is a BinaryInform reply kept in dir/inform.
+type informRecord struct {
+	Model   string         `json:"model"`
+	Region  string         `json:"region"`
+	Version string         `json:"version"`
+	Info    fus.BinaryInfo `json:"info"`
+}
+
+func (rec *informRecord) key() cache.Key {
+	return cache.Key{Model: rec.Model, Region: rec.Region, Version: rec.Version}
+}
+
+func (rec *informRecord) file() string {
+	return rec.Info.ModelPath + rec.Info.BinaryName
+}
+
+type versionReply struct {
+	body    []byte
+	expires time.Time
+}
+
+// New returns a Server keeping its data in dir, which is also a cache.Cache
+// that local susgo instances may share with -cache-dir.
+func New(dir string) (*Server, error) {
+	c, err := cache.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"inform", "partial"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	s := &Server{
+		HTTPClient: http.DefaultClient,
+		FOTAURL:    fota.DefaultBaseURL,
+		Log:        slog.New(slog.DiscardHandler),
+		dir:        dir,
+		cache:      c,
+		informs:    map[cache.Key]*informRecord{},
+		files:      map[string]*informRecord{},
+		imeis:      map[cache.Key]string{},
+		fetches:    map[string]*fetch{},
+		versions:   map[string]*versionReply{},
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "inform"))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, "inform", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		rec := &informRecord{}
+		if err := json.Unmarshal(data, rec); err != nil {
+			s.Log.Warn("skipping unreadable inform record", "file", e.Name(), "err", err)
+			continue
+		}
+		s.informs[rec.key()] = rec
+		s.files[rec.file()] = rec
+	}
+	return s, nil
+}
+
+// Serve accepts connections on ln until ctx is cancelled. Upstream downloads
+// run until ctx is cancelled, also when their clients disconnect, so that
+// the next request finds the firmware cached.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	s.ctx = ctx
+	srv := &http.Server{Handler: s, ReadHeaderTimeout: 30 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdown)
+	}()
+	err := srv.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return ctx.Err()
+	}
+	return err
+}
+
+var versionXMLPath = regexp.MustCompile(`^/firmware/([^/]+)/([^/]+)/version\.xml$`)
+
+// ServeHTTP dispatches to the FUS and FOTA endpoints.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Log.Debug("proxy request", "method", r.Method, "path", r.URL.Path, "range", r.Header.Get("Range"))
+	switch r.URL.Path {
+	case "/NF_DownloadGenerateNonce.do":
+		s.generateNonce(w)
+	case "/NF_DownloadBinaryInform.do":
+		s.binaryInform(w, r)
+	case "/NF_DownloadBinaryInitForMass.do":
+		fusmsg.Write(w, 200, nil, nil)
+	case "/NF_DownloadBinaryForMass.do":
+		s.download(w, r)
+	default:
+		if versionXMLPath.MatchString(r.URL.Path) {
+			s.versionXML(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) generateNonce(w http.ResponseWriter) {
+	enc, err := fus.EncryptNonce(fusmsg.RandomString(rand.Reader, 16))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: fusmsg.RandomString(rand.Reader, 32)})
+	w.Header().Set("NONCE", enc)
+}
+
+func (s *Server) binaryInform(w http.ResponseWriter, r *http.Request) {
+	put, err := fusmsg.ReadPut(r.Body)
+	if err != nil {
+		fusmsg.Write(w, 400, nil, nil)
+		return
+	}
+	fwv, model, region := put["DEVICE_FW_VERSION"], put["DEVICE_MODEL_NAME"], put["DEVICE_LOCAL_CODE"]
+	rec, err := s.inform(r.Context(), fwv, model, region, put["DEVICE_IMEI_PUSH"])
+	if err != nil {
+		s.Log.Warn("upstream BinaryInform failed", "model", model, "region", region, "version", fwv, "err", err)
+		writeUpstreamError(w, err)
+		return
+	}
+	info := rec.Info
+	fusmsg.Write(w, 200, map[string]string{"LATEST_FW_VERSION": info.LatestFWVersion}, map[string]string{
+		"BINARY_NAME":         info.BinaryName,
+		"BINARY_BYTE_SIZE":    fmt.Sprint(info.BinaryByteSize),
+		"BINARY_CRC":          fmt.Sprint(info.BinaryCRC),
+		"MODEL_PATH":          info.ModelPath,
+		"LOGIC_VALUE_FACTORY": info.LogicValueFactory,
+		"DEVICE_MODEL_NAME":   model,
+		"DEVICE_LOCAL_CODE":   region,
+	})
+}
+
+// inform returns the BinaryInform reply for the firmware, asking upstream
+// only if none is stored. It remembers imei for the upstream download.
+func (s *Server) inform(ctx context.Context, fwv, model, region, imei string) (*informRecord, error) {
+	k := cache.Key{Model: model, Region: region, Version: fota.NormalizeVersion(fwv)}
+	s.mu.Lock()
+	rec := s.informs[k]
+	if imei != "" {
+		s.imeis[k] = imei
+	}
+	s.mu.Unlock()
+	if rec != nil {
+		return rec, nil
+	}
+
+	c, err := fus.NewClient(ctx, s.FUS...)
+	if err != nil {
+		return nil, err
+	}
+	info, err := c.BinaryInform(ctx, fwv, model, region, imei)
+	if err != nil {
+		return nil, err
+	}
+	rec = &informRecord{Model: k.Model, Region: k.Region, Version: k.Version, Info: *info}
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(k.Model+"_"+k.Region+"_"+k.Version) + ".json"
+	path := filepath.Join(s.dir, "inform", name)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return nil, err
+	}
+	s.Log.Info("stored upstream BinaryInform", "model", model, "region", region, "version", k.Version, "file", info.BinaryName)
+
+	s.mu.Lock()
+	s.informs[k] = rec
+	s.files[rec.file()] = rec
+	s.mu.Unlock()
+	return rec, nil
+}
+
+// writeUpstreamError passes a FUS rejection on to the client.
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	var se *fus.StatusError
+	switch {
+	case errors.As(err, &se) && se.HTTP:
+		w.WriteHeader(se.Status)
+	case errors.As(err, &se):
+		fusmsg.Write(w, se.Status, nil, nil)
+	default:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("file")
+	s.mu.Lock()
+	rec := s.files[name]
+	s.mu.Unlock()
+	if rec == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	e, err := s.cache.Lookup(rec.key())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if e != nil && e.BinaryName == rec.Info.BinaryName {
+		s.serveCached(w, r, e)
+		return
+	}
+	f, err := s.startFetch(rec)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	f.serve(w, r)
+}
+
+// serveCached serves a complete file from the cache, with its MD5.
+func (s *Server) serveCached(w http.ResponseWriter, r *http.Request, e *cache.Entry) {
+	fd, err := os.Open(e.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer fd.Close()
+	if sum, err := hexToBase64(e.MD5); err == nil {
+		w.Header().Set("Content-MD5", sum)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, fd)
+}
+
+// versionXML serves version.xml from memory or upstream.
+func (s *Server) versionXML(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	s.mu.Lock()
+	v := s.versions[path]
+	s.mu.Unlock()
+	if v == nil || time.Now().After(v.expires) {
+		req, err := http.NewRequestWithContext(r.Context(), "GET", strings.TrimSuffix(s.FOTAURL, "/")+path, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp, err := s.HTTPClient.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if resp.StatusCode != http.StatusOK {
+			w.WriteHeader(resp.StatusCode)
+			w.Write(body)
+			return
+		}
+		ttl := s.VersionTTL
+		if ttl == 0 {
+			ttl = DefaultVersionTTL
+		}
+		v = &versionReply{body: body, expires: time.Now().Add(ttl)}
+		s.mu.Lock()
+		s.versions[path] = v
+		s.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(v.body)
+}
+
+// errNoIMEI is returned for a download whose BinaryInform reply was stored
+// by an earlier run, before any client has sent an IMEI for it again.
+var errNoIMEI = errors.New("no IMEI or serial known for the upstream download; repeat BinaryInform")
+
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattchengg/susgo/fus"
+	"github.com/mattchengg/susgo/fustest"
+)
+
+const (
+	testModel   = "SM-S928B"
+	testRegion  = "EUX"
+	testVersion = "S928BXXS4CYK8/S928BOXM4CYK8/S928BXXS4CYK8/S928BXXS4CYK8"
+	testIMEI    = "351234567871819"
+)
+
+const (
+	informPath   = "/NF_DownloadBinaryInform.do"
+	downloadPath = "/NF_DownloadBinaryForMass.do"
+)
+
+// testRetry keeps retries after a proxy restart short.
+var testRetry = fus.RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+// upstream is a fustest.Server that counts the requests the proxy makes
+// to it and the download bytes it sends.
+type upstream struct {
+	*fustest.Server
+	url string
+
+	mu       sync.Mutex
+	requests map[string]int // by path
+	ranges   []string       // Range headers of download requests
+	sent     int64
+}
+
+func newUpstream(t *testing.T) *upstream {
+	t.Helper()
+	srv, err := fustest.NewServer(fustest.Firmware{Model: testModel, Region: testRegion, Version: testVersion})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	u := &upstream{Server: srv, requests: map[string]int{}}
+	ts := httptest.NewServer(u)
+	t.Cleanup(ts.Close)
+	u.url = ts.URL
+	return u
+}
+
+func (u *upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mu.Lock()
+	u.requests[r.URL.Path]++
+	if r.URL.Path == downloadPath {
+		u.ranges = append(u.ranges, r.Header.Get("Range"))
+		w = &countingWriter{ResponseWriter: w, u: u}
+	}
+	u.mu.Unlock()
+	u.Server.ServeHTTP(w, r)
+}
+
+// count returns the number of requests to path so far.
+func (u *upstream) count(path string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requests[path]
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	u *upstream
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.u.mu.Lock()
+	w.u.sent += int64(n)
+	w.u.mu.Unlock()
+	return n, err
+}
+
+func (w *countingWriter) Flush() {
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// startProxy serves a Server keeping its data in dir, with u as upstream,
+// and returns it, its URL and a function stopping it, which the test
+// cleanup also calls.
+func startProxy(t *testing.T, dir string, u *upstream) (*Server, string, func()) {
+	t.Helper()
+	s, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.FUS = []fus.Option{fus.WithBaseURL(u.url), fus.WithDownloadURL(u.url), fus.WithRetry(testRetry)}
+	s.FOTAURL = u.url
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, ln) }()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			<-done
+			waitFetches(t, s)
+		})
+	}
+	t.Cleanup(stop)
+	return s, "http://" + ln.Addr().String(), stop
+}
+
+// waitFetches waits for the upstream downloads of s to end.
+func waitFetches(t *testing.T, s *Server) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		s.mu.Lock()
+		n := len(s.fetches)
+		s.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("upstream downloads did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// client is a susgo client of the proxy at url, with the session
+// initialized for the test firmware.
+type client struct {
+	*fus.Client
+	file string
+}
+
+func newClient(t *testing.T, url string) *client {
+	t.Helper()
+	ctx := context.Background()
+	c, err := fus.NewClient(ctx, fus.WithBaseURL(url), fus.WithDownloadURL(url), fus.WithRetry(testRetry))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := c.BinaryInform(ctx, testVersion, testModel, testRegion, testIMEI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.BinaryInit(ctx, info.BinaryName); err != nil {
+		t.Fatal(err)
+	}
+	return &client{Client: c, file: info.ModelPath + info.BinaryName}
+}
+
+// get downloads [start, end] of the firmware, or all of it if end is
+// negative.
+func (c *client) get(start, end int64) ([]byte, error) {
+	resp, err := c.DownloadRange(context.Background(), c.file, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func TestSharedInform(t *testing.T) {
+	u := newUpstream(t)
+	dir := t.TempDir()
+	_, url, stop := startProxy(t, dir, u)
+	for range 3 {
+		newClient(t, url)
+	}
+	if n := u.count(informPath); n != 1 {
+		t.Errorf("%d upstream BinaryInform requests for 3 clients, want 1", n)
+	}
+
+	// The reply is stored, so a restarted proxy does not ask again.
+	stop()
+	_, url, _ = startProxy(t, dir, u)
+	newClient(t, url)
+	if n := u.count(informPath); n != 1 {
+		t.Errorf("%d upstream BinaryInform requests after a restart, want 1", n)
+	}
+}
+
+func TestConcurrentClients(t *testing.T) {
+	u := newUpstream(t)
+	want := u.Ciphertext(testModel, testRegion, testVersion)
+	size := int64(len(want))
+	u.Throttle(size) // about a second for the whole file
+	_, url, _ := startProxy(t, t.TempDir(), u)
+
+	// Whole-file and ranged clients join the fetch while it runs.
+	ranges := []struct{ start, end int64 }{
+		{0, -1}, {0, -1}, {0, -1},
+		{0, 99}, {size / 3, size/3 + 4095}, {size - 1000, size - 1}, {size / 2, -1},
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(ranges))
+	for _, rg := range ranges {
+		c := newClient(t, url)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			end := rg.end
+			if end < 0 {
+				end = size - 1
+			}
+			got, err := c.get(rg.start, rg.end)
+			switch {
+			case err != nil:
+				errs <- fmt.Errorf("range %d-%d: %w", rg.start, rg.end, err)
+			case !bytes.Equal(got, want[rg.start:end+1]):
+				errs <- fmt.Errorf("range %d-%d: got %d bytes differing from the file", rg.start, rg.end, len(got))
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := u.count(downloadPath); n != 1 {
+		t.Errorf("%d upstream downloads for %d clients, want 1", n, len(ranges))
+	}
+
+	// A client joining after the fetch has finished is served from the
+	// cache.
+	u.Throttle(0)
+	got, err := newClient(t, url).get(0, -1)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Errorf("download after the fetch: %d bytes, %v", len(got), err)
+	}
+	if n := u.count(downloadPath); n != 1 {
+		t.Errorf("%d upstream downloads after the fetch finished, want 1", n)
+	}
+}
+
+func TestRestartResumes(t *testing.T) {
+	u := newUpstream(t)
+	want := u.Ciphertext(testModel, testRegion, testVersion)
+	u.Throttle(int64(len(want)) / 4)
+	dir := t.TempDir()
+	_, url, stop := startProxy(t, dir, u)
+
+	// Stop the proxy once part of the file has arrived upstream.
+	c := newClient(t, url)
+	go c.get(0, -1)
+	for {
+		parts, _ := filepath.Glob(filepath.Join(dir, "partial", "*.part"))
+		if len(parts) == 1 {
+			if info, err := os.Stat(parts[0]); err == nil && info.Size() > 0 {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+
+	u.Throttle(0)
+	_, url, _ = startProxy(t, dir, u)
+	got, err := newClient(t, url).get(0, -1)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("download after the restart: %d bytes, %v", len(got), err)
+	}
+	u.mu.Lock()
+	ranges := u.ranges
+	u.mu.Unlock()
+	// The rest of the file is requested after the restart, and then only the
+	// headers of the whole file, for its MD5.
+	if len(ranges) < 2 || ranges[0] != "" || !strings.HasPrefix(ranges[1], "bytes=") || ranges[1] == "bytes=0-" {
+		t.Errorf("upstream download ranges = %q, want the whole file, then the rest of it", ranges)
+	}
+}
+
+func TestRestartStoresComplete(t *testing.T) {
+	u := newUpstream(t)
+	want := u.Ciphertext(testModel, testRegion, testVersion)
+	u.Throttle(int64(len(want)) / 4)
+	dir := t.TempDir()
+	_, url, _ := startProxy(t, dir, u)
+
+	// A download completed by an earlier run that stopped before moving it
+	// into the cache.
+	c := newClient(t, url)
+	name := filepath.Base(c.file)
+	if err := os.WriteFile(filepath.Join(dir, "partial", name), want, 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.get(0, -1)
+	if err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("download: %d bytes, %v", len(got), err)
+	}
+
+	// Only the headers are fetched upstream, for the MD5.
+	u.mu.Lock()
+	sent := u.sent
+	u.mu.Unlock()
+	if sent >= int64(len(want))/2 {
+		t.Errorf("%d of %d bytes downloaded upstream for a complete file", sent, len(want))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "partial", name)); !os.IsNotExist(err) {
+		t.Errorf("complete file not moved into the cache: %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mattchengg/susgo/download"
+	"github.com/mattchengg/susgo/firmware"
+	"github.com/mattchengg/susgo/fota"
+)
+
+// remoteFirmware is the firmware zip on the server, read through ranged
+// requests.
+type remoteFirmware struct {
+	dl  *download.Downloader
+	r   *download.Remote
+	zip *zip.Reader
+}
+
+func parseRemoteFlags(args []string) (sub, member string) {
+	if len(args) == 0 {
+		fmt.Println("Error: remote ls or remote get <member> required")
+		os.Exit(1)
+	}
+	sub = args[0]
+	fs := flag.NewFlagSet("remote "+sub, flag.ExitOnError)
+	fs.StringVar(&version, "v", "", "Firmware version")
+	switch sub {
+	case "ls":
+		fs.Parse(args[1:])
+	case "get":
+		fs.StringVar(&outFile, "o", "", "Output file or directory")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fmt.Println("Error: one member name required")
+			os.Exit(1)
+		}
+		member = fs.Arg(0)
+	default:
+		fmt.Printf("Unknown remote command: %s\n", sub)
+		os.Exit(1)
+	}
+	return sub, member
+}
+
+func remote(ctx context.Context, sub, member string) error {
+	j := cliJob()
+	fw, err := j.openRemote(ctx)
+	if err != nil {
+		return err
+	}
+	if sub == "ls" {
+		j.listRemote(fw)
+		return nil
+	}
+	return j.getRemote(ctx, fw, member)
+}
+
+// openRemote reads the central directory of the firmware zip of j.
+func (j *fwJob) openRemote(ctx context.Context) (*remoteFirmware, error) {
+	effectiveIMEI, err := j.deviceID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newFUSClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if j.Version == "" {
+		ver, err := fotaClient.LatestVersion(ctx, j.Model, j.Region)
+		if err != nil {
+			return nil, err
+		}
+		j.Version = ver
+	}
+	info, err := client.BinaryInform(ctx, j.Version, j.Model, j.Region, effectiveIMEI)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.BinaryInit(ctx, info.BinaryName); err != nil {
+		return nil, err
+	}
+
+	key, err := j.key(info.BinaryName, info)
+	if err != nil {
+		return nil, fmt.Errorf("key: %w", err)
+	}
+	dl := &download.Downloader{
+		Client:     client,
+		ModelPath:  info.ModelPath,
+		BinaryName: info.BinaryName,
+		Size:       info.BinaryByteSize,
+		Model:      j.Model,
+		Region:     j.Region,
+		Version:    fota.NormalizeVersion(j.Version),
+		Key:        key,
+		Limiter:    &limiter,
+	}
+	r, err := dl.Remote(ctx)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(r, r.Size())
+	if err != nil {
+		return nil, fmt.Errorf("reading the remote zip: %w", err)
+	}
+	fmt.Fprintf(j.out, "Device: %s | CSC: %s\nFW: %s\n", j.Model, j.Region, j.Version)
+	return &remoteFirmware{dl: dl, r: r, zip: zr}, nil
+}
+
+func (j *fwJob) listRemote(fw *remoteFirmware) {
+	tw := tabwriter.NewWriter(j.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nNAME\tSIZE\tBYTES")
+	var total uint64
+	for _, f := range fw.zip.File {
+		fmt.Fprintf(tw, "%s\t%s\t%d\n", f.Name, download.FormatSize(int64(f.UncompressedSize64)), f.UncompressedSize64)
+		total += f.UncompressedSize64
+	}
+	tw.Flush()
+	fmt.Fprintf(j.out, "%d files, %s\n", len(fw.zip.File), download.FormatSize(int64(total)))
+}
+
+// findMember returns the member named name, or the only one whose name
+// starts with name, such as "CSC" for CSC_*.tar.md5.
+func (fw *remoteFirmware) findMember(name string) (*zip.File, error) {
+	var matches []*zip.File
+	for _, f := range fw.zip.File {
+		if f.Name == name {
+			return f, nil
+		}
+		if strings.HasPrefix(f.Name, name) {
+			matches = append(matches, f)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no member %q in the firmware; see remote ls", name)
+	case 1:
+		return matches[0], nil
+	}
+	names := make([]string, len(matches))
+	for i, f := range matches {
+		names[i] = f.Name
+	}
+	return nil, fmt.Errorf("%q matches %s", name, strings.Join(names, ", "))
+}
+
+// getRemote downloads one member of the firmware zip into j.OutFile, the
+// current directory by default, or stdout for "-".
+func (j *fwJob) getRemote(ctx context.Context, fw *remoteFirmware, name string) error {
+	f, err := fw.findMember(name)
+	if err != nil {
+		return err
+	}
+	out := j.OutFile
+	switch {
+	case out == "":
+		out = filepath.Base(f.Name)
+	case out == "-":
+	default:
+		if info, err := os.Stat(out); err == nil && info.IsDir() {
+			out = filepath.Join(out, filepath.Base(f.Name))
+		}
+	}
+	size := int64(f.UncompressedSize64)
+	fmt.Fprintf(j.out, "Member: %s\nSize: %s\nPath: %s\n", f.Name, download.FormatSize(size), out)
+
+	if out != "-" {
+		if exists(out) {
+			fmt.Fprintf(j.out, "%s exists\n", out)
+			return nil
+		}
+		if !noSpace {
+			if err := download.CheckSpace(out, size); err != nil {
+				return err
+			}
+		}
+	}
+
+	off, err := f.DataOffset()
+	if err != nil {
+		return err
+	}
+	var bar *ProgressBar
+	if j.progress {
+		bar = NewProgressBar(j.out, int64(f.CompressedSize64))
+		bar.Start()
+		fw.dl.Progress = bar.Add
+	}
+	err = j.extract(fw, f, off, out)
+	if bar != nil {
+		bar.Finish()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	fmt.Fprintln(j.out, "Done, CRC-32 verified.")
+	return nil
+}
+
+// extract writes the data of f, at off in the zip, to out and checks its
+// CRC-32. A file is written to its temporary name and renamed once checked.
+func (j *fwJob) extract(fw *remoteFirmware, f *zip.File, off int64, out string) error {
+	body, err := fw.r.NewReader(off, int64(f.CompressedSize64))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var src io.Reader
+	switch f.Method {
+	case zip.Store:
+		src = body
+	case zip.Deflate:
+		fr := flate.NewReader(body)
+		defer fr.Close()
+		src = fr
+	default:
+		return fmt.Errorf("%s: unsupported compression method %d", f.Name, f.Method)
+	}
+
+	if out == "-" {
+		return checkMember(f, os.Stdout, src)
+	}
+	return firmware.CreateAtomic(out, func(fd *os.File) error {
+		return checkMember(f, fd, src)
+	})
+}
+
+// checkMember copies the data of f from src to w and checks its size and
+// CRC-32.
+func checkMember(f *zip.File, w io.Writer, src io.Reader) error {
+	h := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(w, h), src)
+	if err != nil {
+		return err
+	}
+	if n != int64(f.UncompressedSize64) {
+		return &download.IntegrityError{Check: "size", Want: fmt.Sprint(f.UncompressedSize64), Got: fmt.Sprint(n)}
+	}
+	if h.Sum32() != f.CRC32 {
+		return &download.IntegrityError{Check: "CRC-32", Want: fmt.Sprintf("%08x", f.CRC32), Got: fmt.Sprintf("%08x", h.Sum32())}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mattchengg/susgo/fustest"
+)
+
+func TestRemoteGet(t *testing.T) {
+	files := map[string][]byte{
+		"AP_S928BXXS4CYK8.tar.md5":  bytes.Repeat([]byte("stored member "), 5000),
+		"CSC_S928BOXM4CYK8.tar.md5": bytes.Repeat([]byte("deflated member "), 5000),
+	}
+	startServer(t, fustest.Firmware{
+		Model: testModel, Region: testRegion, Version: testVer,
+		Files: files, Deflate: []string{"CSC_S928BOXM4CYK8.tar.md5"},
+	})
+
+	var log bytes.Buffer
+	dir := t.TempDir()
+	job := &fwJob{Model: testModel, Region: testRegion, IMEI: testIMEI, OutFile: dir, out: &log}
+	ctx := context.Background()
+	fw, err := job.openRemote(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// remote ls
+	job.listRemote(fw)
+	for name, data := range files {
+		if !strings.Contains(log.String(), name) || !strings.Contains(log.String(), fmt.Sprint(len(data))) {
+			t.Errorf("remote ls does not list %s of %d bytes:\n%s", name, len(data), log.String())
+		}
+	}
+
+	// remote get, by prefix, of a stored and a deflated member
+	if f, err := fw.findMember("CSC"); err != nil || f.Method != zip.Deflate {
+		t.Fatalf("CSC member not deflated: %v", err)
+	}
+	for _, prefix := range []string{"AP", "CSC"} {
+		if err := job.getRemote(ctx, fw, prefix); err != nil {
+			t.Fatalf("remote get %s: %v\n%s", prefix, err, log.String())
+		}
+	}
+	for name, data := range files {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: got %d bytes differing from the member, %v", name, len(got), err)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != len(files) {
+		t.Errorf("%d files in the output directory, want only the %d members", len(entries), len(files))
+	}
+}
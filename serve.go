@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/mattchengg/susgo/proxy"
+)
+
+var (
+	listenAddr string
+	serveDir   string
+)
+
+func parseServeFlags(args []string) {
+	fs := flag.NewFlagSet("serve-cache", flag.ExitOnError)
+	fs.StringVar(&listenAddr, "listen", ":8080", "Address to listen on")
+	fs.StringVar(&serveDir, "dir", "", "Cache directory (default: -cache-dir)")
+	fs.Func("limit", "Upstream bandwidth limit in bytes/s (K, M, G suffixes)", func(s string) (err error) {
+		limiter.Rate, err = parseRate(s)
+		return err
+	})
+	addStallFlags(fs)
+	fs.Parse(args)
+	if serveDir == "" {
+		serveDir = cacheDir
+	}
+	if serveDir == "" {
+		fmt.Println("Error: -dir or -cache-dir required")
+		os.Exit(1)
+	}
+}
+
+// serveCache runs the caching proxy until ctx is cancelled. Upstream
+// requests go to the -fus-url, -download-url and -fota-url servers.
+func serveCache(ctx context.Context, hc *http.Client) error {
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	s, err := proxy.New(serveDir)
+	if err != nil {
+		return err
+	}
+	s.FUS = fusOpts
+	s.FOTAURL = fotaURL
+	s.HTTPClient = hc
+	s.Limiter = &limiter
+	s.StallTimeout = stallTime
+	s.MinSpeed = minSpeed
+	s.Log = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Serving %s on http://%s\n", serveDir, ln.Addr())
+	fmt.Println("Point clients at it with -fus-url, -download-url and -fota-url.")
+	if err := s.Serve(ctx, ln); !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
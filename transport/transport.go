@@ -0,0 +1,138 @@
+// Package transport builds the HTTP client shared by the FUS and FOTA
+// clients: proxy selection, extra trusted CAs and per-phase timeouts.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Default per-phase timeouts.
+const (
+	DefaultConnectTimeout = 15 * time.Second
+	DefaultHeaderTimeout  = 30 * time.Second
+	DefaultReadTimeout    = 60 * time.Second
+)
+
+// Config describes how requests reach the servers. Zero timeouts use the
+// defaults; negative timeouts disable the limit.
+type Config struct {
+	// Proxy is an http://, https:// or socks5:// proxy URL. If empty the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables apply.
+	Proxy string
+
+	// CAFile is a PEM bundle trusted in addition to the system roots, e.g.
+	// for a TLS-inspecting proxy.
+	CAFile string
+
+	// ConnectTimeout bounds TCP connect plus TLS handshake.
+	ConnectTimeout time.Duration
+	// HeaderTimeout bounds the wait for response headers after the request
+	// has been sent.
+	HeaderTimeout time.Duration
+	// ReadTimeout bounds the time a single read may wait for data, so a
+	// stalled body fails instead of hanging.
+	ReadTimeout time.Duration
+}
+
+// NewClient returns an *http.Client configured by cfg.
+func NewClient(cfg Config) (*http.Client, error) {
+	connectTimeout := orDefault(cfg.ConnectTimeout, DefaultConnectTimeout)
+	headerTimeout := orDefault(cfg.HeaderTimeout, DefaultHeaderTimeout)
+	readTimeout := orDefault(cfg.ReadTimeout, DefaultReadTimeout)
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %w", err)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("proxy: unsupported scheme %q", u.Scheme)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.CAFile != "" {
+		pool, err := loadCAs(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	t := &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || readTimeout <= 0 {
+				return conn, err
+			}
+			return &deadlineConn{Conn: conn, timeout: readTimeout}, nil
+		},
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: headerTimeout,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// Default returns a client with default timeouts and proxies taken from the
+// environment.
+func Default() *http.Client {
+	c, _ := NewClient(Config{})
+	return c
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	switch {
+	case d == 0:
+		return def
+	case d < 0:
+		return 0
+	}
+	return d
+}
+
+func loadCAs(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("CA bundle: %w", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA bundle: no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// deadlineConn arms a fresh read deadline before every read, turning an idle
+// connection into a timeout error.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}